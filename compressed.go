@@ -0,0 +1,207 @@
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// focusPoint is a place that gets more pixels on a Compressed map.
+// Weight is the extra magnification at the centre (1 doubles the scale, -0.5 halves it)
+// and Radius is the distance in metres at which the magnification fades out.
+type focusPoint struct {
+	Name   string
+	Lat    float64
+	Lon    float64
+	Weight float64
+	Radius float64
+}
+
+// focusStage is a focusPoint on the Mercator pixel plane, already moved by the stages before it.
+type focusStage struct {
+	x      float64
+	y      float64
+	weight float64
+	radius float64
+}
+
+// compressedMercator is a Mercator projection followed by a radial magnification around each focus point.
+// Each stage is a monotonic radial map, so their composition keeps the map topologically correct.
+type compressedMercator struct {
+	scale    float64
+	v_west   float64
+	w_north  float64
+	offset_x float64
+	offset_y float64
+	width    int
+	height   int
+	stages   []focusStage
+}
+
+// focusProfile is the magnification profile phi(t) = (1-t^2)^2; focusProfileIntegral is its integral from 0.
+func focusProfile(t float64) float64 {
+	if t >= 1 {
+		return 0
+	}
+	return (1 - t*t) * (1 - t*t)
+}
+func focusProfileIntegral(t float64) float64 {
+	if t >= 1 {
+		return 8.0 / 15.0
+	}
+	return t - 2*t*t*t/3 + t*t*t*t*t/5
+}
+
+// radial maps a distance from the centre of the stage to the magnified distance.
+func (st focusStage) radial(r float64) float64 {
+	return r + st.weight*st.radius*focusProfileIntegral(r/st.radius)
+}
+
+// inverseRadial solves st.radial(r) == r_warped by Newton's method kept inside a bracket.
+func (st focusStage) inverseRadial(r_warped float64) float64 {
+	low, high := 0.0, r_warped+math.Abs(st.weight)*st.radius
+	r := r_warped
+	for i := 0; i < 50; i++ {
+		f := st.radial(r) - r_warped
+		if math.Abs(f) < 1e-9 {
+			break
+		}
+		if f > 0 {
+			high = r
+		} else {
+			low = r
+		}
+		r -= f / (1 + st.weight*focusProfile(r/st.radius))
+		if r <= low || r >= high {
+			r = (low + high) / 2
+		}
+	}
+	return r
+}
+
+func (st focusStage) forward(x, y float64) (float64, float64) {
+	dx, dy := x-st.x, y-st.y
+	r := math.Hypot(dx, dy)
+	if r == 0 {
+		return x, y
+	}
+	k := st.radial(r) / r
+	return st.x + dx*k, st.y + dy*k
+}
+
+func (st focusStage) inverse(x, y float64) (float64, float64) {
+	dx, dy := x-st.x, y-st.y
+	r := math.Hypot(dx, dy)
+	if r == 0 {
+		return x, y
+	}
+	k := st.inverseRadial(r) / r
+	return st.x + dx*k, st.y + dy*k
+}
+
+func newCompressedMercator(scale float64, focus []focusPoint) compressedMercator {
+	var cm compressedMercator
+	cm.scale = scale
+	cm.v_west = lonToV(area.West)
+	cm.w_north = latToW(area.North)
+
+	for _, fp := range focus {
+		if fp.Weight <= -1 {
+			log.Fatalf("focus %q: weight must be greater than -1, got %g\n", fp.Name, fp.Weight)
+		}
+		if fp.Radius <= 0 {
+			log.Fatalf("focus %q: radius must be positive, got %g\n", fp.Name, fp.Radius)
+		}
+		var st focusStage
+		st.x, st.y = cm.warp(cm.mercatorPixel(fp.Lat, fp.Lon))
+		st.weight = fp.Weight
+		// radius in pixels of the plain Mercator map at the latitude of the focus
+		st.radius = fp.Radius / (parallelRadius(fp.Lat) / scale)
+		cm.stages = append(cm.stages, st)
+	}
+
+	// the canvas is the bounding box of the warped area outline
+	dv := lonToV(area.East) - lonToV(area.West)
+	dw := latToW(area.North) - latToW(area.South)
+	min_x, min_y, max_x, max_y := cm.outline(area.North, area.East, area.South, area.West, int(dv*scale), int(dw*scale))
+	cm.offset_x = math.Floor(min_x + 0.5)
+	cm.offset_y = math.Floor(min_y + 0.5)
+	cm.width = int(math.Floor(max_x+0.5) - cm.offset_x)
+	cm.height = int(math.Floor(max_y+0.5) - cm.offset_y)
+	return cm
+}
+
+// mercatorPixel returns the position on the plain Mercator map before any focus is applied.
+func (cm compressedMercator) mercatorPixel(lat, lon float64) (float64, float64) {
+	return (lonToV(wrapLon(lon)) - cm.v_west) * cm.scale, (cm.w_north - latToW(lat)) * cm.scale
+}
+
+func (cm compressedMercator) warp(x, y float64) (float64, float64) {
+	for _, st := range cm.stages {
+		x, y = st.forward(x, y)
+	}
+	return x, y
+}
+
+func (cm compressedMercator) latLonToPixel(lat, lon float64) (float64, float64) {
+	x, y := cm.warp(cm.mercatorPixel(lat, lon))
+	return x - cm.offset_x, y - cm.offset_y
+}
+
+func (cm compressedMercator) pixelToLatLon(x, y float64) (float64, float64) {
+	x += cm.offset_x
+	y += cm.offset_y
+	for i := len(cm.stages) - 1; i >= 0; i-- {
+		x, y = cm.stages[i].inverse(x, y)
+	}
+	return wToLat(cm.w_north - y/cm.scale), vToLon(x/cm.scale + cm.v_west)
+}
+
+// footprint returns the bounding box in degrees of the pixel centred on (x, y).
+func (cm compressedMercator) footprint(x, y int) mapRectangle {
+	fp := mapRectangle{North: math.Inf(-1), East: math.Inf(-1), South: math.Inf(1), West: math.Inf(1)}
+	for _, corner := range [4][2]float64{{-0.5, -0.5}, {0.5, -0.5}, {-0.5, 0.5}, {0.5, 0.5}} {
+		lat, lon := cm.pixelToLatLon(float64(x)+corner[0], float64(y)+corner[1])
+		fp.North, fp.South = math.Max(fp.North, lat), math.Min(fp.South, lat)
+		fp.East, fp.West = math.Max(fp.East, lon), math.Min(fp.West, lon)
+	}
+	return fp
+}
+
+// outline returns the bounding box on the warped plane of the rectangle given in degrees,
+// walking each edge in steps of about one pixel.
+func (cm compressedMercator) outline(north, east, south, west float64, steps_x, steps_y int) (min_x, min_y, max_x, max_y float64) {
+	steps_x = intMax(steps_x, 16)
+	steps_y = intMax(steps_y, 16)
+	min_x, min_y = math.Inf(1), math.Inf(1)
+	max_x, max_y = math.Inf(-1), math.Inf(-1)
+	add := func(lat, lon float64) {
+		x, y := cm.warp(cm.mercatorPixel(lat, lon))
+		min_x, max_x = math.Min(min_x, x), math.Max(max_x, x)
+		min_y, max_y = math.Min(min_y, y), math.Max(max_y, y)
+	}
+	for i := 0; i <= steps_x; i++ {
+		lon := west + (east-west)*float64(i)/float64(steps_x)
+		add(north, lon)
+		add(south, lon)
+	}
+	for i := 0; i <= steps_y; i++ {
+		lat := south + (north-south)*float64(i)/float64(steps_y)
+		add(lat, west)
+		add(lat, east)
+	}
+	return
+}
+
+func (cm compressedMercator) size() (int, int) {
+	return cm.width, cm.height
+}
+
+// compressedMap renders the Compressed style. The warped area is not a rectangle: with margin "water" the rest
+// of the canvas is sea, otherwise it is filled with the real terrain around the area.
+func compressedMap(pixelsize float64, base_lat float64, focus []focusPoint, dryrun bool) *heightMap {
+	scale := mercatorScale(pixelsize, base_lat)
+	reportMercatorPixelsize(scale, base_lat)
+	cm := newCompressedMercator(scale, focus)
+	println("Compressed width,height:", cm.width, cm.height)
+	return renderMap(cm, dryrun)
+}
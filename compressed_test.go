@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFocusStageRadial(t *testing.T) {
+	tests := []struct {
+		name string
+		st   focusStage
+		r    float64
+		want float64
+	}{
+		{"centre", focusStage{weight: 1, radius: 10}, 0, 0},
+		// F(1) = 8/15, so the edge of the disc moves out by weight*radius*8/15
+		{"edge", focusStage{weight: 1, radius: 10}, 10, 10 + 10*8.0/15},
+		{"beyond", focusStage{weight: 1, radius: 10}, 25, 25 + 10*8.0/15},
+		{"shrink", focusStage{weight: -0.5, radius: 10}, 30, 30 - 5*8.0/15},
+		{"no weight", focusStage{weight: 0, radius: 10}, 4, 4},
+	}
+	for _, tt := range tests {
+		if got := tt.st.radial(tt.r); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s: radial(%g) = %g, want %g", tt.name, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestFocusStageLocalScale(t *testing.T) {
+	// the local scale is 1+weight at the centre and 1 beyond the radius
+	st := focusStage{weight: 2, radius: 20}
+	h := 1e-6
+	if got := (st.radial(h) - st.radial(0)) / h; math.Abs(got-3) > 1e-4 {
+		t.Errorf("scale at the centre = %g, want 3", got)
+	}
+	if got := (st.radial(30+h) - st.radial(30)) / h; math.Abs(got-1) > 1e-4 {
+		t.Errorf("scale beyond the radius = %g, want 1", got)
+	}
+}
+
+func TestFocusStageInverseRadial(t *testing.T) {
+	for _, st := range []focusStage{
+		{weight: 0.5, radius: 10},
+		{weight: 3, radius: 40},
+		{weight: -0.9, radius: 15},
+		{weight: 0, radius: 5},
+	} {
+		for _, r := range []float64{0, 0.01, 1, 7.5, 10, 14.99, 15, 39, 40, 100} {
+			if got := st.inverseRadial(st.radial(r)); math.Abs(got-r) > 1e-7 {
+				t.Errorf("weight %g radius %g: inverseRadial(radial(%g)) = %.10f", st.weight, st.radius, r, got)
+			}
+		}
+	}
+}
+
+func TestFocusStageInverse(t *testing.T) {
+	st := focusStage{x: 50, y: 40, weight: 1.5, radius: 25}
+	for _, p := range [][2]float64{{50, 40}, {51, 40}, {60, 55}, {20, 10}, {120, 40}} {
+		x, y := st.inverse(st.forward(p[0], p[1]))
+		if math.Hypot(x-p[0], y-p[1]) > 1e-7 {
+			t.Errorf("inverse(forward(%v)) = %g, %g", p, x, y)
+		}
+	}
+}
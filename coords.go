@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mapPoint is a place converted between latitude/longitude and pixels of a rendered map.
+// Pixel (x, y) is Simutrans tile (x, y): x to the east and y to the south from the north west corner.
+type mapPoint struct {
+	name string
+	lat  float64
+	lon  float64
+	x    float64
+	y    float64
+	// population is read from a "population" column, for the towns of a scenario
+	population float64
+}
+
+// tile returns the Simutrans tile holding the point, the pixel whose centre is nearest.
+func (p mapPoint) tile() (int, int) {
+	return int(math.Floor(p.x + 0.5)), int(math.Floor(p.y + 0.5))
+}
+
+// outside tells where the point lies: "map" when its tile is not on the map, "area" when it is on the map
+// but in the margin outside the configured area, and "" when it is inside.
+func (p mapPoint) outside(proj projection) string {
+	width, height := proj.size()
+	if tx, ty := p.tile(); tx < 0 || ty < 0 || tx >= width || ty >= height {
+		return "map"
+	}
+	if lon := wrapLon(p.lon); p.lat < area.South || p.lat > area.North || lon < area.West || lon > area.East {
+		return "area"
+	}
+	return ""
+}
+
+// projectionFromMetadata rebuilds the projection written in a .meta.json sidecar. It also returns the image
+// the sidecar belongs to.
+func projectionFromMetadata(filename string) (projection, string) {
+	md := readMetadata(filename)
+	area = md.Area
+	use_ellipsoid = md.Projection.Ellipsoid
+	mp := md.Projection
+	width, height := md.Image.Width, md.Image.Height
+	image_file := filepath.Join(filepath.Dir(filename), md.Image.Filename)
+	switch mp.Style {
+	case "Degree":
+		return equirectangularProjection{mp.Scale_x, mp.Scale_y, width, height}, image_file
+	case "Mercator":
+		return mercatorProjection{mp.Scale, mp.V_west, mp.W_north, width, height}, image_file
+	case "Compressed":
+		cm := compressedMercator{scale: mp.Scale, v_west: mp.V_west, w_north: mp.W_north,
+			offset_x: mp.Offset_x, offset_y: mp.Offset_y, width: width, height: height}
+		for _, st := range mp.Stages {
+			cm.stages = append(cm.stages, focusStage{st.X, st.Y, st.Weight, st.Radius})
+		}
+		return cm, image_file
+	}
+	log.Fatalf("%s: unknown projection style %q\n", filename, mp.Style)
+	return nil, ""
+}
+
+// projectionFromConfig builds the projection a config file renders with, without reading any tiles.
+// It also returns the image the config renders to and its level table, which is nil in the "auto" mode.
+func projectionFromConfig(filename string) (projection, string, []level) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var jsonIn jsonData
+	if err := json.Unmarshal(data, &jsonIn); err != nil {
+		log.Fatalln(err)
+	}
+	area = jsonIn.Area
+	normalizeArea()
+	use_ellipsoid = jsonIn.Drawing.Ellipsoid
+	table := configLevelTable(jsonIn.Elevation)
+	d := jsonIn.Drawing
+	switch strings.ToLower(d.Style) {
+	case "mercator":
+		return newMercatorProjection(d.Pixelsize, d.Baselat), jsonIn.Filename, table
+	case "compressed":
+		return newCompressedMercator(mercatorScale(d.Pixelsize, d.Baselat), d.Focus), jsonIn.Filename, table
+	}
+	return newEquirectangularProjection(d.Pixelsize, d.Baselat), jsonIn.Filename, table
+}
+
+// parsePair reads "a,b" as two numbers.
+func parsePair(s string) (float64, float64) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		log.Fatalf("expected two numbers separated by a comma, got %q\n", s)
+	}
+	a, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	b, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return a, b
+}
+
+// csvColumn returns the index of the first header matching one of names, or -1.
+func csvColumn(header []string, names ...string) int {
+	for i, h := range header {
+		for _, name := range names {
+			// GTFS files often start with a byte order mark
+			if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// readPointsCSV reads points from a CSV with a header. Columns lat/lon (or latitude, longitude, lng) are
+// converted to pixels; without them, columns x/y are converted to latitude and longitude.
+// GTFS stops.txt is read as well: its platforms, the rows with a parent_station, are left out so that
+// every station appears once.
+func readPointsCSV(filename string, proj projection) []mapPoint {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := records[0]
+	name := csvColumn(header, "name", "stop_name", "city")
+	lat, lon := csvColumn(header, "lat", "latitude", "stop_lat"), csvColumn(header, "lon", "lng", "longitude", "stop_lon")
+	x, y := csvColumn(header, "x"), csvColumn(header, "y")
+	parent := csvColumn(header, "parent_station")
+	population := csvColumn(header, "population", "pop")
+	if (lat < 0 || lon < 0) && (x < 0 || y < 0) {
+		log.Fatalf("%s: needs lat and lon or x and y columns\n", filename)
+	}
+
+	var points []mapPoint
+	for line, r := range records[1:] {
+		if parent >= 0 && strings.TrimSpace(r[parent]) != "" {
+			continue
+		}
+		var p mapPoint
+		if name >= 0 {
+			p.name = r[name]
+		}
+		number := func(column int) float64 {
+			v, err := strconv.ParseFloat(strings.TrimSpace(r[column]), 64)
+			if err != nil {
+				log.Fatalf("%s line %d: %v\n", filename, line+2, err)
+			}
+			return v
+		}
+		if population >= 0 && strings.TrimSpace(r[population]) != "" {
+			p.population = number(population)
+		}
+		if lat >= 0 && lon >= 0 {
+			p.lat, p.lon = number(lat), number(lon)
+			p.x, p.y = proj.latLonToPixel(p.lat, p.lon)
+		} else {
+			p.x, p.y = number(x), number(y)
+			p.lat, p.lon = proj.pixelToLatLon(p.x, p.y)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// readPointsGeoJSON reads the Point and MultiPoint features of a GeoJSON file, named by their "name" property.
+func readPointsGeoJSON(filename string, proj projection) []mapPoint {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		log.Fatalln(err)
+	}
+	var points []mapPoint
+	skipped := 0
+	for _, f := range fc.Features {
+		var coordinates [][]float64
+		switch f.Geometry.Type {
+		case "Point":
+			var c []float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &c)
+			coordinates = [][]float64{c}
+		case "MultiPoint":
+			err = json.Unmarshal(f.Geometry.Coordinates, &coordinates)
+		default:
+			skipped++
+			continue
+		}
+		if err != nil {
+			log.Fatalf("%s: %v\n", filename, err)
+		}
+		name, _ := f.Properties["name"].(string)
+		for _, c := range coordinates {
+			if len(c) < 2 {
+				continue
+			}
+			// GeoJSON positions are longitude first
+			p := mapPoint{name: name, lat: c[1], lon: c[0]}
+			p.x, p.y = proj.latLonToPixel(p.lat, p.lon)
+			points = append(points, p)
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d features that are not points skipped\n", filename, skipped)
+	}
+	return points
+}
+
+func writePointsCSV(w io.Writer, points []mapPoint, proj projection) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "lat", "lon", "x", "y", "tile_x", "tile_y", "outside"})
+	outside := 0
+	for _, p := range points {
+		tx, ty := p.tile()
+		where := p.outside(proj)
+		if where != "" {
+			outside++
+		}
+		cw.Write([]string{p.name,
+			strconv.FormatFloat(p.lat, 'f', 7, 64), strconv.FormatFloat(p.lon, 'f', 7, 64),
+			strconv.FormatFloat(p.x, 'f', 3, 64), strconv.FormatFloat(p.y, 'f', 3, 64),
+			strconv.Itoa(tx), strconv.Itoa(ty), where})
+	}
+	cw.Flush()
+	if outside > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d points are outside the map or the area\n", outside, len(points))
+	}
+	return cw.Error()
+}
+
+// coordsCommand is the "coords" subcommand, which converts between latitude/longitude and map pixels
+// with the projection of a config file or of a render sidecar.
+func coordsCommand(args []string) {
+	flags := flag.NewFlagSet("coords", flag.ExitOnError)
+	meta := flags.String("m", "", "sidecar .meta.json written with the map")
+	config := flags.String("f", "", "config file of the map, when there is no sidecar")
+	latlon := flags.String("p", "", "one point as lat,lon")
+	pixel := flags.String("x", "", "one pixel or tile as x,y")
+	csv_file := flags.String("csv", "", "CSV with lat,lon or x,y columns")
+	geojson := flags.String("geojson", "", "GeoJSON with Point features")
+	output := flags.String("o", "", "CSV to write, stdout when empty")
+	flags.Parse(args)
+
+	var proj projection
+	switch {
+	case *meta != "":
+		proj, _ = projectionFromMetadata(*meta)
+	case *config != "":
+		proj, _, _ = projectionFromConfig(*config)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var points []mapPoint
+	if *latlon != "" {
+		var p mapPoint
+		p.lat, p.lon = parsePair(*latlon)
+		p.x, p.y = proj.latLonToPixel(p.lat, p.lon)
+		points = append(points, p)
+	}
+	if *pixel != "" {
+		var p mapPoint
+		p.x, p.y = parsePair(*pixel)
+		p.lat, p.lon = proj.pixelToLatLon(p.x, p.y)
+		points = append(points, p)
+	}
+	if *csv_file != "" {
+		points = append(points, readPointsCSV(*csv_file, proj)...)
+	}
+	if *geojson != "" {
+		points = append(points, readPointsGeoJSON(*geojson, proj)...)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writePointsCSV(w, points, proj); err != nil {
+		log.Fatalln(err)
+	}
+}
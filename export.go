@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// elevationExport is one file holding the elevation grid in metres, for other engines and for re-leveling
+// without reading the tiles again. Format is png16, raw or asc, chosen from the extension of Filename when empty.
+// Type is int16, uint16 or float32 for raw, Byteorder little or big. Integer values are (metres - Offset) / Scale.
+type elevationExport struct {
+	Filename  string
+	Format    string
+	Type      string
+	Byteorder string
+	Scale     float64
+	Offset    float64
+}
+
+// metres returns the elevation of pixel i as it enters the level table: water at the water level, NaN without data.
+func (hm *heightMap) metres(i int) float64 {
+	if hm.water[i] {
+		return float64(water_level)
+	}
+	return float64(hm.elevation[i])
+}
+
+// exportElevation writes the elevation grid of hm in every configured format, with a world file next to
+// the PNGs when worldfile is set.
+func exportElevation(hm *heightMap, exports []elevationExport, worldfile bool) {
+	for _, ex := range exports {
+		format := strings.ToLower(ex.Format)
+		if format == "" {
+			switch strings.ToLower(filepath.Ext(ex.Filename)) {
+			case ".png":
+				format = "png16"
+			case ".r16", ".raw":
+				format = "raw"
+			case ".asc":
+				format = "asc"
+			case ".tif", ".tiff":
+				format = "geotiff"
+			default:
+				log.Fatalf("export: can not tell the format of %q\n", ex.Filename)
+			}
+		}
+		scale := ex.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		// integer returns the stored value of pixel i clamped to low..high, or nodata
+		integer := func(i int, low, high, nodata float64) float64 {
+			m := hm.metres(i)
+			if math.IsNaN(m) {
+				return nodata
+			}
+			return math.Max(low, math.Min(high, math.Floor(0.5+(m-ex.Offset)/scale)))
+		}
+
+		f, err := os.OpenFile(ex.Filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w := bufio.NewWriter(f)
+		switch format {
+		case "png16":
+			img := image.NewGray16(image.Rect(0, 0, hm.width, hm.height))
+			for i := range hm.elevation {
+				img.SetGray16(i%hm.width, i/hm.width, color.Gray16{uint16(integer(i, 0, math.MaxUint16, 0))})
+			}
+			err = png.Encode(w, img)
+		case "raw":
+			err = writeRaw(w, hm, ex, integer)
+		case "asc":
+			err = writeASCIIGrid(w, hm)
+		case "geotiff":
+			err = writeElevationGeoTIFF(w, hm)
+		default:
+			log.Fatalf("export: unknown format %q\n", ex.Format)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		f.Close()
+		if format == "png16" && worldfile {
+			saveWorldFile(ex.Filename)
+		}
+		if format == "asc" || format == "geotiff" || strings.ToLower(ex.Type) == "float32" {
+			fmt.Printf("export: %s (%s) in metres\n", ex.Filename, format)
+		} else {
+			fmt.Printf("export: %s (%s), metres = value * %g %+g\n", ex.Filename, format, scale, ex.Offset)
+		}
+	}
+}
+
+func writeRaw(w io.Writer, hm *heightMap, ex elevationExport, integer func(i int, low, high, nodata float64) float64) error {
+	var order binary.ByteOrder
+	switch strings.ToLower(ex.Byteorder) {
+	case "little", "":
+		order = binary.LittleEndian
+	case "big":
+		order = binary.BigEndian
+	default:
+		log.Fatalf("export: byteorder must be little or big, got %q\n", ex.Byteorder)
+	}
+	var buf [4]byte
+	for i := range hm.elevation {
+		var b []byte
+		switch strings.ToLower(ex.Type) {
+		case "int16", "":
+			b = buf[:2]
+			order.PutUint16(b, uint16(int16(integer(i, math.MinInt16+1, math.MaxInt16, math.MinInt16))))
+		case "uint16":
+			b = buf[:2]
+			order.PutUint16(b, uint16(integer(i, 0, math.MaxUint16, 0)))
+		case "float32":
+			b = buf[:4]
+			order.PutUint32(b, math.Float32bits(float32(hm.metres(i))))
+		default:
+			log.Fatalf("export: type must be int16, uint16 or float32, got %q\n", ex.Type)
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeASCIIGrid writes the ESRI ASCII grid in metres. Degree maps have cells that are not square in degrees
+// and get the dx/dy header that GDAL reads; Compressed maps are not affine and are written in pixel units.
+func writeASCIIGrid(w io.Writer, hm *heightMap) error {
+	const nodata = -9999
+	transform, _, ok := geoTransform(map_projection)
+	if !ok {
+		fmt.Println("export: the projection is not affine, the ASCII grid is in pixel units")
+		transform = [6]float64{0, 1, 0, float64(hm.height), 0, -1}
+	}
+	fmt.Fprintf(w, "ncols %d\nnrows %d\n", hm.width, hm.height)
+	fmt.Fprintf(w, "xllcorner %.10g\nyllcorner %.10g\n", transform[0], transform[3]+transform[5]*float64(hm.height))
+	if transform[1] == -transform[5] {
+		fmt.Fprintf(w, "cellsize %.10g\n", transform[1])
+	} else {
+		fmt.Fprintf(w, "dx %.10g\ndy %.10g\n", transform[1], -transform[5])
+	}
+	fmt.Fprintf(w, "NODATA_value %d\n", nodata)
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			m := hm.metres(y*hm.width + x)
+			if math.IsNaN(m) {
+				m = nodata
+			}
+			if x > 0 {
+				io.WriteString(w, " ")
+			}
+			io.WriteString(w, strconv.FormatFloat(m, 'f', -1, 32))
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
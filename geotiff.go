@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TIFF tags and GeoKeys written by writeGeoTIFF
+const (
+	tiff_image_width        = 256
+	tiff_image_length       = 257
+	tiff_bits_per_sample    = 258
+	tiff_compression        = 259
+	tiff_photometric        = 262
+	tiff_strip_offsets      = 273
+	tiff_samples_per_pixel  = 277
+	tiff_rows_per_strip     = 278
+	tiff_strip_byte_counts  = 279
+	tiff_planar_config      = 284
+	tiff_sample_format      = 339
+	tiff_model_pixel_scale  = 33550
+	tiff_model_tiepoint     = 33922
+	tiff_geo_key_directory  = 34735
+	tiff_gdal_nodata        = 42113
+	geokey_model_type       = 1024
+	geokey_raster_type      = 1025
+	geokey_geographic_type  = 2048
+	geokey_projected_cs     = 3072
+	geokey_model_projected  = 1
+	geokey_model_geographic = 2
+	geokey_pixel_is_area    = 1
+)
+
+// TIFF field types
+const (
+	tiff_short  = 3
+	tiff_long   = 4
+	tiff_ascii  = 2
+	tiff_double = 12
+)
+
+type tiffField struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	data  []byte
+}
+
+func tiffShorts(tag uint16, values ...uint16) tiffField {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, values)
+	return tiffField{tag, tiff_short, uint32(len(values)), buf.Bytes()}
+}
+
+func tiffLong(tag uint16, value uint32) tiffField {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, value)
+	return tiffField{tag, tiff_long, 1, buf.Bytes()}
+}
+
+func tiffDoubles(tag uint16, values ...float64) tiffField {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, values)
+	return tiffField{tag, tiff_double, uint32(len(values)), buf.Bytes()}
+}
+
+func tiffASCII(tag uint16, value string) tiffField {
+	return tiffField{tag, tiff_ascii, uint32(len(value) + 1), append([]byte(value), 0)}
+}
+
+// writeGeoTIFF writes a single band, single strip, uncompressed little endian TIFF. bits is 8 for grey values
+// or 32 for float32 elevation. When the map projection is affine the tiepoint, pixel scale and GeoKeys are
+// added so that GIS software places the image on the ground.
+func writeGeoTIFF(w io.Writer, width, height, bits int, float bool, pixels []byte, nodata string) error {
+	fields := []tiffField{
+		tiffLong(tiff_image_width, uint32(width)),
+		tiffLong(tiff_image_length, uint32(height)),
+		tiffShorts(tiff_bits_per_sample, uint16(bits)),
+		tiffShorts(tiff_compression, 1),
+		tiffShorts(tiff_photometric, 1), // black is zero
+		tiffLong(tiff_strip_offsets, 0), // filled in below
+		tiffShorts(tiff_samples_per_pixel, 1),
+		tiffLong(tiff_rows_per_strip, uint32(height)),
+		tiffLong(tiff_strip_byte_counts, uint32(len(pixels))),
+		tiffShorts(tiff_planar_config, 1),
+	}
+	if float {
+		fields = append(fields, tiffShorts(tiff_sample_format, 3))
+	} else {
+		fields = append(fields, tiffShorts(tiff_sample_format, 1))
+	}
+	if transform, epsg, ok := geoTransform(map_projection); ok {
+		fields = append(fields,
+			tiffDoubles(tiff_model_pixel_scale, transform[1], -transform[5], 0),
+			tiffDoubles(tiff_model_tiepoint, 0, 0, 0, transform[0], transform[3], 0))
+		// version 1.1.0 and three keys, sorted by id
+		model, cs_key := uint16(geokey_model_projected), uint16(geokey_projected_cs)
+		if epsg == 4326 {
+			model, cs_key = geokey_model_geographic, geokey_geographic_type
+		}
+		keys := []uint16{1, 1, 0, 3,
+			geokey_model_type, 0, 1, model,
+			geokey_raster_type, 0, 1, geokey_pixel_is_area,
+			cs_key, 0, 1, uint16(epsg)}
+		fields = append(fields, tiffShorts(tiff_geo_key_directory, keys...))
+	} else {
+		fmt.Println("geotiff: the projection is not affine, writing a TIFF without georeferencing")
+	}
+	if nodata != "" {
+		fields = append(fields, tiffASCII(tiff_gdal_nodata, nodata))
+	}
+
+	// header, IFD, values that do not fit in an entry, then the pixels
+	ifd_size := 2 + 12*len(fields) + 4
+	extra := 8 + ifd_size
+	var values bytes.Buffer
+	offsets := make([]uint32, len(fields))
+	for k, f := range fields {
+		if len(f.data) > 4 {
+			offsets[k] = uint32(extra + values.Len())
+			values.Write(f.data)
+			if values.Len()%2 == 1 {
+				values.WriteByte(0)
+			}
+		}
+	}
+	strip := uint32(extra + values.Len())
+	for k := range fields {
+		if fields[k].tag == tiff_strip_offsets {
+			binary.LittleEndian.PutUint32(fields[k].data, strip)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{'I', 'I', 42, 0})
+	binary.Write(bw, binary.LittleEndian, uint32(8))
+	binary.Write(bw, binary.LittleEndian, uint16(len(fields)))
+	for k, f := range fields {
+		binary.Write(bw, binary.LittleEndian, []uint16{f.tag, f.kind})
+		binary.Write(bw, binary.LittleEndian, f.count)
+		if len(f.data) > 4 {
+			binary.Write(bw, binary.LittleEndian, offsets[k])
+		} else {
+			var entry [4]byte
+			copy(entry[:], f.data)
+			bw.Write(entry[:])
+		}
+	}
+	binary.Write(bw, binary.LittleEndian, uint32(0)) // no next IFD
+	bw.Write(values.Bytes())
+	bw.Write(pixels)
+	return bw.Flush()
+}
+
+func saveGeoTIFF(img *image.Gray, filename string) {
+	pixels := make([]byte, 0, img.Rect.Dx()*img.Rect.Dy())
+	for y := 0; y < img.Rect.Dy(); y++ {
+		pixels = append(pixels, img.Pix[y*img.Stride:y*img.Stride+img.Rect.Dx()]...)
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	if err = writeGeoTIFF(f, img.Rect.Dx(), img.Rect.Dy(), 8, false, pixels, ""); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// writeElevationGeoTIFF writes the elevation grid of hm in metres as float32, NaN without data.
+func writeElevationGeoTIFF(w io.Writer, hm *heightMap) error {
+	pixels := make([]byte, 4*len(hm.elevation))
+	for i := range hm.elevation {
+		binary.LittleEndian.PutUint32(pixels[4*i:], math.Float32bits(float32(hm.metres(i))))
+	}
+	return writeGeoTIFF(w, hm.width, hm.height, 32, true, pixels, "nan")
+}
+
+// projection_wkt is the WKT of the reference systems returned by geoTransform, as written in .prj files
+var projection_wkt = map[int]string{
+	4326: `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]]`,
+	3857: `PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],` +
+		`PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],` +
+		`UNIT["metre",1],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0 +lon_0=0 +x_0=0 +y_0=0 +k=1 +units=m +nadgrids=@null +no_defs"]]`,
+	3395: `PROJCS["WGS 84 / World Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],` +
+		`PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1]]`,
+}
+
+// saveWorldFile writes the world file (.pgw for .png, .bpw for .bmp, ...) and the .prj next to an image.
+// World files give the centre of the upper left pixel, not its corner.
+func saveWorldFile(filename string) {
+	transform, epsg, ok := geoTransform(map_projection)
+	if !ok {
+		fmt.Printf("worldfile: the projection is not affine, no world file for %s\n", filename)
+		return
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	world_ext := ".wld"
+	if len(ext) == 4 {
+		world_ext = ext[:2] + ext[3:] + "w"
+	}
+	world := fmt.Sprintf("%.12g\n0\n0\n%.12g\n%.12g\n%.12g\n",
+		transform[1], transform[5], transform[0]+transform[1]/2, transform[3]+transform[5]/2)
+	if err := ioutil.WriteFile(base+world_ext, []byte(world), 0666); err != nil {
+		log.Fatalln(err)
+	}
+	if err := ioutil.WriteFile(base+".prj", []byte(projection_wkt[epsg]+"\n"), 0666); err != nil {
+		log.Fatalln(err)
+	}
+}
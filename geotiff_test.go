@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+type tiffEntry struct {
+	kind  uint16
+	count uint32
+	value []byte // the value, read at its offset when it does not fit in the entry
+}
+
+// readTIFF parses the header and first IFD of a little endian TIFF and returns the tags in file order.
+func readTIFF(t *testing.T, b []byte) ([]uint16, map[uint16]tiffEntry) {
+	t.Helper()
+	if !bytes.Equal(b[:4], []byte{'I', 'I', 42, 0}) {
+		t.Fatalf("header %v is not a little endian TIFF", b[:4])
+	}
+	ifd := int(binary.LittleEndian.Uint32(b[4:]))
+	count := int(binary.LittleEndian.Uint16(b[ifd:]))
+	if next := binary.LittleEndian.Uint32(b[ifd+2+12*count:]); next != 0 {
+		t.Errorf("next IFD at %d, want none", next)
+	}
+	size := map[uint16]int{tiff_ascii: 1, tiff_short: 2, tiff_long: 4, tiff_double: 8}
+	var order []uint16
+	entries := make(map[uint16]tiffEntry)
+	for k := 0; k < count; k++ {
+		e := b[ifd+2+12*k:]
+		tag, kind, n := binary.LittleEndian.Uint16(e), binary.LittleEndian.Uint16(e[2:]), binary.LittleEndian.Uint32(e[4:])
+		length := size[kind] * int(n)
+		var value []byte
+		if length > 4 {
+			at := int(binary.LittleEndian.Uint32(e[8:]))
+			if at%2 != 0 {
+				t.Errorf("tag %d: value at odd offset %d", tag, at)
+			}
+			value = b[at : at+length]
+		} else {
+			value = e[8 : 8+length]
+		}
+		order = append(order, tag)
+		entries[tag] = tiffEntry{kind, n, value}
+	}
+	return order, entries
+}
+
+func shorts(b []byte) []uint16 {
+	v := make([]uint16, len(b)/2)
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, v)
+	return v
+}
+
+func doubles(b []byte) []float64 {
+	v := make([]float64, len(b)/8)
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, v)
+	return v
+}
+
+func TestWriteGeoTIFF(t *testing.T) {
+	defer func(a mapRectangle, p projection, e bool) { area, map_projection, use_ellipsoid = a, p, e }(area, map_projection, use_ellipsoid)
+	area = mapRectangle{North: 36, East: 137, South: 34, West: 135}
+	pixels := []byte{1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		name     string
+		proj     projection
+		geo      bool
+		model    uint16
+		cs_key   uint16
+		epsg     uint16
+		scale    [2]float64
+		tiepoint [2]float64
+	}{
+		{"degree", equirectangularProjection{scale_x: 100, scale_y: 125, width: 3, height: 2}, true,
+			geokey_model_geographic, geokey_geographic_type, 4326, [2]float64{0.01, 0.008}, [2]float64{134.995, 36.004}},
+		{"mercator", mercatorProjection{scale: 1000, v_west: 0.1, w_north: 0.5, width: 3, height: 2}, true,
+			geokey_model_projected, geokey_projected_cs, 3857,
+			[2]float64{EARTH_RADIUS / 1000, EARTH_RADIUS / 1000}, [2]float64{EARTH_RADIUS * (0.1 - 0.0005), EARTH_RADIUS * (0.5 + 0.0005)}},
+		{"compressed", compressedMercator{scale: 1000, width: 3, height: 2}, false, 0, 0, 0, [2]float64{}, [2]float64{}},
+	}
+	for _, tt := range tests {
+		map_projection = tt.proj
+		var buf bytes.Buffer
+		if err := writeGeoTIFF(&buf, 3, 2, 8, false, pixels, ""); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		order, entries := readTIFF(t, b)
+		// TIFF readers expect the tags in ascending order
+		for k := 1; k < len(order); k++ {
+			if order[k] <= order[k-1] {
+				t.Errorf("%s: tag %d after tag %d", tt.name, order[k], order[k-1])
+			}
+		}
+		long := func(tag uint16) uint32 { return binary.LittleEndian.Uint32(entries[tag].value) }
+		if long(tiff_image_width) != 3 || long(tiff_image_length) != 2 {
+			t.Errorf("%s: size %dx%d, want 3x2", tt.name, long(tiff_image_width), long(tiff_image_length))
+		}
+		if s := shorts(entries[tiff_bits_per_sample].value); s[0] != 8 {
+			t.Errorf("%s: %d bits per sample", tt.name, s[0])
+		}
+		strip, length := long(tiff_strip_offsets), long(tiff_strip_byte_counts)
+		if int(strip+length) != len(b) || !bytes.Equal(b[strip:strip+length], pixels) {
+			t.Errorf("%s: strip at %d of %d bytes does not hold the pixels", tt.name, strip, length)
+		}
+
+		_, has_keys := entries[tiff_geo_key_directory]
+		if has_keys != tt.geo {
+			t.Errorf("%s: GeoKeys written %t, want %t", tt.name, has_keys, tt.geo)
+		}
+		if !tt.geo {
+			continue
+		}
+		keys := shorts(entries[tiff_geo_key_directory].value)
+		want := []uint16{1, 1, 0, 3,
+			geokey_model_type, 0, 1, tt.model,
+			geokey_raster_type, 0, 1, geokey_pixel_is_area,
+			tt.cs_key, 0, 1, tt.epsg}
+		if len(keys) != len(want) {
+			t.Fatalf("%s: GeoKey directory %v, want %v", tt.name, keys, want)
+		}
+		for k := range keys {
+			if keys[k] != want[k] {
+				t.Errorf("%s: GeoKey directory %v, want %v", tt.name, keys, want)
+				break
+			}
+		}
+		scale, tiepoint := doubles(entries[tiff_model_pixel_scale].value), doubles(entries[tiff_model_tiepoint].value)
+		for k := 0; k < 2; k++ {
+			if math.Abs(scale[k]-tt.scale[k]) > 1e-9*math.Abs(tt.scale[k]) {
+				t.Errorf("%s: pixel scale %v, want %v", tt.name, scale[:2], tt.scale)
+			}
+			if math.Abs(tiepoint[3+k]-tt.tiepoint[k]) > 1e-9*math.Abs(tt.tiepoint[k]) {
+				t.Errorf("%s: tiepoint %v, want %v", tt.name, tiepoint[3:5], tt.tiepoint)
+			}
+		}
+	}
+}
+
+func TestWriteElevationGeoTIFF(t *testing.T) {
+	defer func(p projection, w int16) { map_projection, water_level = p, w }(map_projection, water_level)
+	map_projection = compressedMercator{}
+	water_level = -5
+	hm := newHeightMap(2, 1)
+	hm.elevation[0] = 12.5
+	hm.water[1] = true
+	var buf bytes.Buffer
+	if err := writeElevationGeoTIFF(&buf, hm); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	_, entries := readTIFF(t, b)
+	if s := shorts(entries[tiff_sample_format].value); s[0] != 3 {
+		t.Errorf("sample format %d, want 3 (float)", s[0])
+	}
+	if nodata := string(entries[tiff_gdal_nodata].value); nodata != "nan\x00" {
+		t.Errorf("GDAL_NODATA %q, want nan", nodata)
+	}
+	strip := binary.LittleEndian.Uint32(entries[tiff_strip_offsets].value)
+	for k, want := range []float32{12.5, -5} {
+		if got := math.Float32frombits(binary.LittleEndian.Uint32(b[int(strip)+4*k:])); got != want {
+			t.Errorf("pixel %d = %g, want %g", k, got, want)
+		}
+	}
+}
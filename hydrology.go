@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// hydrology describes the conditioning of the land so that water drains to the sea.
+// Fill raises every depression to its spill point, Carve cuts river channels where the flow accumulation
+// reaches Threshold pixels, Depth metres deep.
+type hydrology struct {
+	Fill  bool
+	Carve *riverCarving
+}
+
+type riverCarving struct {
+	Threshold int
+	Depth     float64
+}
+
+// drain_epsilon is the fall in metres added between a filled pixel and the one it drains into,
+// so that no flat area is left without a direction of flow.
+const drain_epsilon = 0.01
+
+var d8 = [8][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}, {-1, -1}, {1, -1}, {-1, 1}, {1, 1}}
+
+type floodItem struct {
+	index     int
+	elevation float32
+}
+
+type floodQueue []floodItem
+
+func (q floodQueue) Len() int            { return len(q) }
+func (q floodQueue) Less(i, j int) bool  { return q[i].elevation < q[j].elevation }
+func (q floodQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *floodQueue) Push(x interface{}) { *q = append(*q, x.(floodItem)) }
+func (q *floodQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// fillDepressions is the priority-flood of Barnes et al. (2014) with an epsilon fall. Water and the edge
+// of the map are the outlets; the land is visited from the lowest outlet up, and every pixel lower than the
+// one it was reached from is raised just above it. Returns the number of raised pixels.
+func (hm *heightMap) fillDepressions() int {
+	visited := make([]bool, len(hm.elevation))
+	var queue floodQueue
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			edge := x == 0 || y == 0 || x == hm.width-1 || y == hm.height-1
+			if !hm.isLand(i) || edge {
+				visited[i] = true
+				if !math.IsNaN(float64(hm.elevation[i])) {
+					queue = append(queue, floodItem{i, hm.elevation[i]})
+				}
+			}
+		}
+	}
+	heap.Init(&queue)
+
+	raised := 0
+	for queue.Len() > 0 {
+		item := heap.Pop(&queue).(floodItem)
+		x, y := item.index%hm.width, item.index/hm.width
+		for _, d := range d8 {
+			nx, ny := x+d[0], y+d[1]
+			if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+				continue
+			}
+			j := ny*hm.width + nx
+			if visited[j] {
+				continue
+			}
+			visited[j] = true
+			if hm.elevation[j] <= item.elevation {
+				hm.elevation[j] = item.elevation + drain_epsilon
+				raised++
+			}
+			heap.Push(&queue, floodItem{j, hm.elevation[j]})
+		}
+	}
+	return raised
+}
+
+// flowDirections returns for each land pixel the index of its steepest downhill neighbour, -1 for outlets.
+func (hm *heightMap) flowDirections() []int {
+	flow := make([]int, len(hm.elevation))
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			flow[i] = -1
+			if !hm.isLand(i) {
+				continue
+			}
+			steepest := 0.0
+			for _, d := range d8 {
+				nx, ny := x+d[0], y+d[1]
+				if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+					continue
+				}
+				j := ny*hm.width + nx
+				if math.IsNaN(float64(hm.elevation[j])) {
+					continue
+				}
+				slope := float64(hm.elevation[i]-hm.elevation[j]) / math.Hypot(float64(d[0]), float64(d[1]))
+				if slope > steepest {
+					steepest = slope
+					flow[i] = j
+				}
+			}
+		}
+	}
+	return flow
+}
+
+// carveRivers lowers the pixels whose flow accumulation reaches rc.Threshold by rc.Depth metres and then
+// makes every river pixel lower than the one upstream of it. Carved land never goes below drain_epsilon above
+// the water level, since it keeps its land flag. Returns the number of river pixels.
+func (hm *heightMap) carveRivers(rc riverCarving) int {
+	threshold := rc.Threshold
+	if threshold <= 0 {
+		threshold = 100
+	}
+	flow := hm.flowDirections()
+
+	// from the highest pixel down, which is an order where every pixel comes before the one it drains into
+	var order []int
+	for i := range hm.elevation {
+		if hm.isLand(i) {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool { return hm.elevation[order[a]] > hm.elevation[order[b]] })
+	accumulation := make([]int, len(hm.elevation))
+	for _, i := range order {
+		accumulation[i]++
+		if flow[i] >= 0 {
+			accumulation[flow[i]] += accumulation[i]
+		}
+	}
+
+	floor := float32(water_level) + drain_epsilon
+	rivers := 0
+	for _, i := range order {
+		if accumulation[i] >= threshold {
+			// land that is already lower, as in polders, is left where it is
+			e := float64(hm.elevation[i])
+			hm.elevation[i] = float32(math.Min(e, math.Max(float64(floor), e-rc.Depth)))
+			rivers++
+		}
+	}
+	for _, i := range order {
+		j := flow[i]
+		if accumulation[i] >= threshold && j >= 0 && hm.isLand(j) && hm.elevation[j] >= hm.elevation[i] {
+			// at the floor the river runs flat to the sea
+			hm.elevation[j] = float32(math.Max(float64(floor), float64(hm.elevation[i]-drain_epsilon)))
+		}
+	}
+	return rivers
+}
+
+// conditionHydrology fills depressions and carves rivers as configured.
+func (hm *heightMap) conditionHydrology(h hydrology) {
+	if h.Fill {
+		fmt.Printf("hydrology: %d pixels raised to fill depressions\n", hm.fillDepressions())
+	}
+	if h.Carve != nil {
+		fmt.Printf("hydrology: %d river pixels carved\n", hm.carveRivers(*h.Carve))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// drainsToOutlet reports whether following the flow directions from pixel i ends at the edge of the map
+// or next to water.
+func drainsToOutlet(hm *heightMap, flow []int, i int) bool {
+	for steps := 0; steps <= len(flow); steps++ {
+		if flow[i] < 0 {
+			x, y := i%hm.width, i/hm.width
+			return !hm.isLand(i) || x == 0 || y == 0 || x == hm.width-1 || y == hm.height-1
+		}
+		i = flow[i]
+	}
+	return false
+}
+
+func TestFillDepressions(t *testing.T) {
+	// a basin behind a rim at 10 m, inside land sloping to the edge
+	hm := gridHeightMap(7,
+		5, 5, 5, 5, 5, 5, 5,
+		5, 10, 10, 10, 10, 10, 5,
+		5, 10, 2, 3, 1, 10, 5,
+		5, 10, 4, 2, 3, 10, 5,
+		5, 10, 3, 1, 2, 10, 5,
+		5, 10, 10, 10, 10, 10, 5,
+		5, 5, 5, 5, 5, 5, 5,
+	)
+	if raised := hm.fillDepressions(); raised != 9 {
+		t.Errorf("%d pixels raised, want the 9 of the basin", raised)
+	}
+	flow := hm.flowDirections()
+	for y := 1; y < 6; y++ {
+		for x := 1; x < 6; x++ {
+			i := y*hm.width + x
+			if !drainsToOutlet(hm, flow, i) {
+				t.Errorf("pixel %d,%d at %v does not drain to an outlet", x, y, hm.elevation[i])
+			}
+			if x > 1 && x < 5 && y > 1 && y < 5 && hm.elevation[i] <= 10 {
+				t.Errorf("basin pixel %d,%d at %v, not above the rim", x, y, hm.elevation[i])
+			}
+		}
+	}
+
+	// land already draining is left as it is
+	slope := gridHeightMap(4, 1, 2, 3, 4, 2, 3, 4, 5, 3, 4, 5, 6)
+	if raised := slope.fillDepressions(); raised != 0 {
+		t.Errorf("%d pixels raised on a slope", raised)
+	}
+}
+
+func TestCarveRivers(t *testing.T) {
+	defer func(w int16) { water_level = w }(water_level)
+	water_level = 0
+	// a valley falling to the sea on the left, with a polder below sea level near its mouth
+	hm := newHeightMap(12, 5)
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			hm.elevation[i] = float32(0.5 + 0.2*float64(x) + math.Abs(float64(y-2)))
+			if x == 0 {
+				hm.water[i], hm.elevation[i] = true, 0
+			}
+		}
+	}
+	polder := 2*hm.width + 1
+	hm.elevation[polder] = -1
+
+	if rivers := hm.carveRivers(riverCarving{Threshold: 3, Depth: 5}); rivers == 0 {
+		t.Fatal("no river carved")
+	}
+	floor := float32(water_level) + drain_epsilon
+	for i, e := range hm.elevation {
+		if hm.isLand(i) && i != polder && e < floor {
+			t.Errorf("pixel %d,%d carved to %v, below %v", i%hm.width, i/hm.width, e, floor)
+		}
+	}
+	if e := hm.elevation[polder]; e != -1 {
+		t.Errorf("polder moved to %v", e)
+	}
+	// the river along the valley never climbs towards the sea
+	for x := 2; x < hm.width; x++ {
+		if a, b := hm.elevation[2*hm.width+x-1], hm.elevation[2*hm.width+x]; a > b {
+			t.Errorf("river at %d is %v, higher than %v upstream", x-1, a, b)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// levelInterpolation decides how the brightness between the levels is chosen. Stepped paints every level
+// with its own brightness, the ramps treat each level as an anchor and interpolate between neighbours.
+type levelInterpolation int8
+
+const (
+	Stepped levelInterpolation = iota
+	LinearRamp
+	SmoothRamp
+)
+
+var level_interpolation levelInterpolation
+var level_anchors []levelAnchor
+
+type levelAnchor struct {
+	elevation float64
+	bright    float64
+}
+
+// levelAnchors returns the anchor of every level sorted by elevation. The anchor is "at" when given,
+// otherwise the middle of min and max, or the finite end of the first and last open ranges.
+func levelAnchors(table []level) []levelAnchor {
+	var anchors []levelAnchor
+	for _, l := range table {
+		var a levelAnchor
+		a.bright = float64(l.Bright)
+		switch {
+		case l.At != nil:
+			a.elevation = *l.At
+		case l.Min <= math.MinInt16+1:
+			a.elevation = float64(l.Max)
+		case l.Max >= math.MaxInt16:
+			a.elevation = float64(l.Min)
+		default:
+			a.elevation = (float64(l.Min) + float64(l.Max)) / 2
+		}
+		anchors = append(anchors, a)
+	}
+	sort.SliceStable(anchors, func(i, j int) bool { return anchors[i].elevation < anchors[j].elevation })
+	return anchors
+}
+
+// rampBright interpolates the brightness of elevation between the two anchors around it.
+func rampBright(elevation int16) uint8 {
+	e := float64(elevation)
+	if e <= level_anchors[0].elevation {
+		return uint8(level_anchors[0].bright)
+	}
+	for i := 1; i < len(level_anchors); i++ {
+		a, b := level_anchors[i-1], level_anchors[i]
+		if e > b.elevation {
+			continue
+		}
+		t := (e - a.elevation) / (b.elevation - a.elevation)
+		if level_interpolation == SmoothRamp {
+			t = t * t * (3 - 2*t)
+		}
+		return uint8(math.Floor(0.5 + a.bright + (b.bright-a.bright)*t))
+	}
+	return uint8(level_anchors[len(level_anchors)-1].bright)
+}
+
+// configLevelTable returns the level table of the elevation settings of a config: the level list as written,
+// or the table of the "simutrans" mode. It is nil in the "auto" mode, whose table needs the rendered elevation.
+func configLevelTable(e elevation) []level {
+	switch strings.ToLower(e.Mode) {
+	case "simutrans":
+		if e.Simutrans == nil {
+			log.Fatalln("elevation.mode is simutrans but elevation.simutrans is missing")
+		}
+		return simutransLevelTable(*e.Simutrans, e.Water)
+	case "auto":
+		return nil
+	}
+	return e.Level
+}
+
+// simutransLevels describes the height levels of Simutrans for the "simutrans" elevation mode.
+// Step is the number of metres per height level and Levels the number of levels including the sea.
+// Convention names how the target Simutrans version turns grey values into height levels.
+type simutransLevels struct {
+	Step       float64
+	Levels     int
+	Convention string
+	Brightstep int
+}
+
+// brightStep returns the number of grey values that make up one height level for a convention.
+func brightStep(convention string) int {
+	switch strings.ToLower(convention) {
+	case "legacy", "legacy-small":
+		// one level every 16 grey values, as in heightmaps of older versions
+		return 16
+	case "legacy-large":
+		return 8
+	case "linear", "":
+		return 1
+	}
+	log.Fatalf("elevation.simutrans: unknown convention %q\n", convention)
+	return 0
+}
+
+// simutransLevelTable builds a level table where each height level gets the grey value in the middle
+// of its band, so that each output grey value maps back to exactly one level in the game.
+// Level 0 is everything at or below water, level k covers the k-th step above it.
+func simutransLevelTable(sl simutransLevels, water int16) []level {
+	if sl.Step <= 0 {
+		log.Fatalln("elevation.simutrans: step must be positive")
+	}
+	step := sl.Brightstep
+	if step <= 0 {
+		step = brightStep(sl.Convention)
+	}
+	// the bottom of the last level, water + (levels-1)*Step, must fit in int16
+	fit := int(math.Floor((math.MaxInt16-float64(water))/sl.Step)) + 1
+	levels := sl.Levels
+	if levels <= 0 {
+		levels = 256 / step
+		if levels > fit {
+			fmt.Printf("elevation.simutrans: %d levels of %v m reach past %d, using %d levels\n", levels, sl.Step, math.MaxInt16, fit)
+			levels = fit
+		}
+	}
+	if levels*step > 256 {
+		log.Fatalf("elevation.simutrans: %d levels of %d grey values do not fit in 256\n", levels, step)
+	}
+	if levels > fit {
+		log.Fatalf("elevation.simutrans: %d levels of %v m above water %d reach past %d, at most %d fit\n", levels, sl.Step, water, math.MaxInt16, fit)
+	}
+
+	var table []level
+	table = append(table, level{Min: math.MinInt16, Max: water, Bright: uint8(step / 2)})
+	for k := 1; k < levels; k++ {
+		var l level
+		l.Min = clampElevation(float64(water)+float64(k-1)*sl.Step) + 1
+		l.Max = clampElevation(float64(water) + float64(k)*sl.Step)
+		if k == levels-1 {
+			l.Max = math.MaxInt16
+		}
+		l.Bright = uint8(k*step + step/2)
+		table = append(table, l)
+	}
+	return table
+}
+
+// autoLevels describes the level table generated from the rendered elevation in the "auto" elevation mode.
+type autoLevels struct {
+	Strategy  string
+	Steps     int
+	Brightmin uint8
+	Brightmax uint8
+	Gamma     float64
+	Output    string
+}
+
+// autoLevelTable builds a level table from the land elevation of hm. The land between its lowest and highest
+// point is split into Steps levels, linearly, logarithmically, by a gamma curve or so that every level holds
+// the same number of pixels (histogram). Water and below get Brightmin, the highest level Brightmax.
+func autoLevelTable(hm *heightMap, al autoLevels, water int16) []level {
+	steps := al.Steps
+	if steps <= 0 {
+		steps = 16
+	}
+	bright_min, bright_max := al.Brightmin, al.Brightmax
+	if bright_max == 0 {
+		bright_max = 255
+	}
+	if bright_max < bright_min {
+		log.Fatalln("elevation.auto: brightmax is lower than brightmin")
+	}
+
+	var land []float64
+	for i, e := range hm.elevation {
+		if hm.water[i] || math.IsNaN(float64(e)) || e <= float32(water) {
+			continue
+		}
+		land = append(land, float64(e))
+	}
+	sort.Float64s(land)
+	low, high := float64(water), float64(water)+1
+	if len(land) > 0 {
+		low, high = math.Min(low, land[0]), math.Max(high, land[len(land)-1])
+	}
+
+	// bounds[k] is the top of level k
+	bounds := make([]float64, steps+1)
+	for k := 0; k <= steps; k++ {
+		t := float64(k) / float64(steps)
+		switch strings.ToLower(al.Strategy) {
+		case "linear", "":
+			bounds[k] = low + (high-low)*t
+		case "log":
+			bounds[k] = low + math.Expm1(math.Log1p(high-low)*t)
+		case "gamma":
+			gamma := al.Gamma
+			if gamma <= 0 {
+				gamma = 1
+			}
+			bounds[k] = low + (high-low)*math.Pow(t, gamma)
+		case "histogram":
+			if len(land) == 0 {
+				bounds[k] = low + (high-low)*t
+			} else {
+				bounds[k] = land[intMin(len(land)-1, int(t*float64(len(land))))]
+			}
+		default:
+			log.Fatalf("elevation.auto: unknown strategy %q\n", al.Strategy)
+		}
+	}
+
+	var table []level
+	table = append(table, level{Min: math.MinInt16, Max: water, Bright: bright_min})
+	for k := 1; k <= steps; k++ {
+		var l level
+		l.Min = table[len(table)-1].Max + 1
+		l.Max = clampElevation(math.Floor(bounds[k]))
+		if l.Max < l.Min {
+			// flat parts of the histogram would give empty levels
+			l.Max = l.Min
+		}
+		if k == steps {
+			l.Max = math.MaxInt16
+		}
+		l.Bright = uint8(float64(bright_min) + math.Floor(0.5+float64(bright_max-bright_min)*float64(k)/float64(steps)))
+		table = append(table, l)
+		if l.Max == math.MaxInt16 {
+			break
+		}
+	}
+	return table
+}
+
+// saveLevelTable writes the level table as an elevation block that can be pasted into a config file,
+// one level per line like the bundled configs.
+func saveLevelTable(table []level, water int16, filename string) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{\n\t\"water\": %d,\n\t\"level\":[\n", water)
+	for i, l := range table {
+		line, err := json.Marshal(l)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		buf.WriteString("\t\t")
+		buf.Write(line)
+		if i < len(table)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\t]\n}\n")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0666); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// rawLevel is a level as written in the config, read loosely so that out of range values can be reported.
+type rawLevel struct {
+	Min    *float64
+	Max    *float64
+	Bright *float64
+	At     *float64
+}
+
+func (rl rawLevel) String() string {
+	field := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	return fmt.Sprintf("{min:%s max:%s bright:%s}", field(rl.Min), field(rl.Max), field(rl.Bright))
+}
+
+// validateLevels checks the level table of a config for inverted ranges, brightness outside 0-255,
+// gaps and overlaps between ranges and brightness that goes down as elevation goes up.
+// Ranges sharing a single boundary value, as in the bundled configs, are not an overlap.
+// Every problem is printed with the offending entries. In strict mode any problem stops simumap.
+func validateLevels(json_file []byte) {
+	var raw struct {
+		Elevation struct {
+			Level  []rawLevel
+			Strict bool
+		}
+	}
+	if err := json.Unmarshal(json_file, &raw); err != nil {
+		log.Fatalln(err)
+	}
+	problems := levelProblems(raw.Elevation.Level)
+	for _, p := range problems {
+		fmt.Println("level table:", p)
+	}
+	if len(problems) > 0 && raw.Elevation.Strict {
+		log.Fatalf("level table has %d problems, not rendering in strict mode\n", len(problems))
+	}
+}
+
+// levelProblems returns the problems of a level table found by validateLevels, one message each.
+func levelProblems(levels []rawLevel) []string {
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	var ranges []int
+	for i, l := range levels {
+		if l.Bright == nil {
+			report("level[%d] %v has no bright", i, l)
+		} else if *l.Bright < 0 || *l.Bright > 255 || *l.Bright != math.Floor(*l.Bright) {
+			report("level[%d] %v: bright must be an integer from 0 to 255", i, l)
+		}
+		if l.Min == nil && l.Max == nil {
+			if l.At == nil {
+				report("level[%d] %v has neither min/max nor at", i, l)
+			}
+			continue
+		}
+		if l.Min == nil || l.Max == nil {
+			report("level[%d] %v needs both min and max", i, l)
+			continue
+		}
+		if *l.Min < math.MinInt16 || *l.Max > math.MaxInt16 {
+			report("level[%d] %v is outside %d to %d", i, l, math.MinInt16, math.MaxInt16)
+		}
+		if *l.Min > *l.Max {
+			report("level[%d] %v: min is greater than max", i, l)
+			continue
+		}
+		ranges = append(ranges, i)
+	}
+
+	sort.SliceStable(ranges, func(a, b int) bool { return *levels[ranges[a]].Min < *levels[ranges[b]].Min })
+	// top is the range reaching highest among those sorted so far, so that a range nested in an earlier
+	// one neither hides its overlap nor opens a gap that the outer range covers
+	top := 0
+	if len(ranges) > 0 {
+		top = ranges[0]
+	}
+	for k := 1; k < len(ranges); k++ {
+		i, j := ranges[k-1], ranges[k]
+		a, b, t := levels[i], levels[j], levels[top]
+		if *b.Min > *t.Max+1 {
+			report("gap from %v to %v between level[%d] %v and level[%d] %v, painted with brightness 16",
+				*t.Max+1, *b.Min-1, top, t, j, b)
+		} else if *b.Min < *t.Max {
+			report("level[%d] %v overlaps level[%d] %v, the one listed first wins", j, b, top, t)
+		}
+		if *b.Max > *t.Max {
+			top = j
+		}
+		if a.Bright != nil && b.Bright != nil && *b.Bright < *a.Bright {
+			report("brightness goes down from level[%d] %v to level[%d] %v", i, a, j, b)
+		}
+	}
+	if len(ranges) > 0 {
+		if first := levels[ranges[0]]; *first.Min > math.MinInt16+1 {
+			report("elevation below %v is not covered by level[%d] %v, painted with brightness 16", *first.Min, ranges[0], first)
+		}
+	}
+	return problems
+}
+
+// checkLevelCoverage reports the land pixels of hm whose elevation is below the lowest or above the highest
+// range of the level table, which the table lookup paints with brightness 16 and the ramps clamp to their
+// first or last anchor. It runs on the final elevation, so generated tables and transforms are checked too.
+// In strict mode any such pixel stops simumap.
+func checkLevelCoverage(hm *heightMap, table []level, strict bool) {
+	problems := levelCoverage(hm, table)
+	for _, p := range problems {
+		fmt.Println("level table:", p)
+	}
+	if len(problems) > 0 && strict {
+		log.Fatalln("elevation outside the level table, not rendering in strict mode")
+	}
+}
+
+// levelCoverage returns a message for the land of hm below the lowest range of table and one for the land
+// above the highest range, when there is any.
+func levelCoverage(hm *heightMap, table []level) []string {
+	low, high := -1, -1
+	for i, l := range table {
+		if l.At != nil || l.Min > l.Max {
+			continue
+		}
+		if low < 0 || l.Min < table[low].Min {
+			low = i
+		}
+		if high < 0 || l.Max > table[high].Max {
+			high = i
+		}
+	}
+	if low < 0 {
+		return nil
+	}
+	below, above := 0, 0
+	for i := range hm.elevation {
+		if hm.water[i] || math.IsNaN(float64(hm.elevation[i])) {
+			continue
+		}
+		if e := hm.level(i); e < table[low].Min {
+			below++
+		} else if e > table[high].Max {
+			above++
+		}
+	}
+	entry := func(l level) string {
+		return fmt.Sprintf("{min:%d max:%d bright:%d}", l.Min, l.Max, l.Bright)
+	}
+	var problems []string
+	if below > 0 {
+		problems = append(problems, fmt.Sprintf("%d land pixels below %v, the bottom of level[%d] %s", below, table[low].Min, low, entry(table[low])))
+	}
+	if above > 0 {
+		problems = append(problems, fmt.Sprintf("%d land pixels above %v, the top of level[%d] %s", above, table[high].Max, high, entry(table[high])))
+	}
+	return problems
+}
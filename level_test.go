@@ -0,0 +1,252 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSimutransLevelTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		sl    simutransLevels
+		water int16
+		want  []level
+	}{
+		{"linear", simutransLevels{Step: 10, Levels: 4}, 0, []level{
+			{Min: math.MinInt16, Max: 0, Bright: 0},
+			{Min: 1, Max: 10, Bright: 1},
+			{Min: 11, Max: 20, Bright: 2},
+			{Min: 21, Max: math.MaxInt16, Bright: 3},
+		}},
+		{"legacy", simutransLevels{Step: 25, Levels: 3, Convention: "legacy"}, -50, []level{
+			{Min: math.MinInt16, Max: -50, Bright: 8},
+			{Min: -49, Max: -25, Bright: 24},
+			{Min: -24, Max: math.MaxInt16, Bright: 40},
+		}},
+		{"brightstep", simutransLevels{Step: 100, Levels: 2, Brightstep: 4}, 0, []level{
+			{Min: math.MinInt16, Max: 0, Bright: 2},
+			{Min: 1, Max: math.MaxInt16, Bright: 6},
+		}},
+	}
+	for _, tt := range tests {
+		got := simutransLevelTable(tt.sl, tt.water)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d levels, want %d: %v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i := range got {
+			if got[i].Min != tt.want[i].Min || got[i].Max != tt.want[i].Max || got[i].Bright != tt.want[i].Bright {
+				t.Errorf("%s: level[%d] = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSimutransLevelTableHighSteps(t *testing.T) {
+	// 256 levels of 200 m pass 32767, so the default is cut to the levels whose bottom still fits
+	for _, water := range []int16{0, 1000, -500} {
+		table := simutransLevelTable(simutransLevels{Step: 200}, water)
+		want := int((math.MaxInt16-float64(water))/200) + 1
+		if len(table) != want {
+			t.Errorf("water %d: %d levels, want %d", water, len(table), want)
+		}
+		for k := 1; k < len(table); k++ {
+			if table[k].Min != table[k-1].Max+1 || table[k].Max < table[k].Min {
+				t.Errorf("water %d: level[%d] %+v does not follow level[%d] %+v", water, k, table[k], k-1, table[k-1])
+				break
+			}
+		}
+	}
+}
+
+func TestSimutransLevelTableDefaultLevels(t *testing.T) {
+	// without levels, the table fills the 256 grey values
+	for _, tt := range []struct {
+		convention string
+		levels     int
+	}{{"linear", 256}, {"legacy", 16}, {"legacy-large", 32}} {
+		table := simutransLevelTable(simutransLevels{Step: 1, Convention: tt.convention}, 0)
+		if len(table) != tt.levels {
+			t.Errorf("%s: %d levels, want %d", tt.convention, len(table), tt.levels)
+		}
+		if last := table[len(table)-1]; last.Max != math.MaxInt16 {
+			t.Errorf("%s: last level %+v does not reach the top", tt.convention, last)
+		}
+	}
+}
+
+// rampHeightMap returns a heightMap of one row of land from 1 to n metres, plus a water pixel and a void.
+func rampHeightMap(n int) *heightMap {
+	hm := newHeightMap(n+2, 1)
+	for i := 0; i < n; i++ {
+		hm.elevation[i] = float32(i + 1)
+	}
+	hm.water[n] = true
+	hm.elevation[n+1] = float32(math.NaN())
+	return hm
+}
+
+func TestAutoLevelTable(t *testing.T) {
+	tests := []struct {
+		name string
+		al   autoLevels
+		want []level
+	}{
+		{"linear", autoLevels{Steps: 4}, []level{
+			{Min: math.MinInt16, Max: 0, Bright: 0},
+			{Min: 1, Max: 25, Bright: 64},
+			{Min: 26, Max: 50, Bright: 128},
+			{Min: 51, Max: 75, Bright: 191},
+			{Min: 76, Max: math.MaxInt16, Bright: 255},
+		}},
+		{"histogram", autoLevels{Strategy: "histogram", Steps: 4, Brightmin: 100, Brightmax: 200}, []level{
+			{Min: math.MinInt16, Max: 0, Bright: 100},
+			{Min: 1, Max: 26, Bright: 125},
+			{Min: 27, Max: 51, Bright: 150},
+			{Min: 52, Max: 76, Bright: 175},
+			{Min: 77, Max: math.MaxInt16, Bright: 200},
+		}},
+		{"gamma", autoLevels{Strategy: "gamma", Gamma: 2, Steps: 2}, []level{
+			{Min: math.MinInt16, Max: 0, Bright: 0},
+			{Min: 1, Max: 25, Bright: 128},
+			{Min: 26, Max: math.MaxInt16, Bright: 255},
+		}},
+	}
+	for _, tt := range tests {
+		got := autoLevelTable(rampHeightMap(100), tt.al, 0)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d levels, want %d: %v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i := range got {
+			if got[i].Min != tt.want[i].Min || got[i].Max != tt.want[i].Max || got[i].Bright != tt.want[i].Bright {
+				t.Errorf("%s: level[%d] = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAutoLevelTableLog(t *testing.T) {
+	// log boundaries are closer together near the water and contiguous all the way up
+	table := autoLevelTable(rampHeightMap(1000), autoLevels{Strategy: "log", Steps: 5}, 0)
+	for i := 1; i < len(table); i++ {
+		if table[i].Min != table[i-1].Max+1 {
+			t.Errorf("level[%d] %+v does not follow level[%d] %+v", i, table[i], i-1, table[i-1])
+		}
+		if i >= 2 && table[i].Max != math.MaxInt16 && table[i].Max-table[i].Min < table[i-1].Max-table[i-1].Min {
+			t.Errorf("level[%d] %+v is narrower than level[%d] %+v", i, table[i], i-1, table[i-1])
+		}
+	}
+}
+
+func TestLevelProblems(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name   string
+		levels []rawLevel
+		want   []string
+	}{
+		{"shared boundaries", []rawLevel{
+			{Min: f(-32767), Max: f(0), Bright: f(100)},
+			{Min: f(0), Max: f(500), Bright: f(150)},
+			{Min: f(500), Max: f(32767), Bright: f(200)},
+		}, nil},
+		{"inverted", []rawLevel{
+			{Min: f(-32767), Max: f(10), Bright: f(100)},
+			{Min: f(20), Max: f(11), Bright: f(150)},
+		}, []string{"level[1] {min:20 max:11 bright:150}: min is greater than max"}},
+		{"bright", []rawLevel{
+			{Min: f(-32767), Max: f(0), Bright: f(300)},
+			{Min: f(1), Max: f(10), Bright: f(1.5)},
+			{Min: f(11), Max: f(20)},
+		}, []string{
+			"level[0] {min:-32767 max:0 bright:300}: bright must be an integer from 0 to 255",
+			"level[1] {min:1 max:10 bright:1.5}: bright must be an integer from 0 to 255",
+			"level[2] {min:11 max:20 bright:-} has no bright",
+			"brightness goes down from level[0] {min:-32767 max:0 bright:300} to level[1] {min:1 max:10 bright:1.5}",
+		}},
+		{"gap and overlap", []rawLevel{
+			{Min: f(-32767), Max: f(0), Bright: f(100)},
+			{Min: f(10), Max: f(100), Bright: f(150)},
+			{Min: f(50), Max: f(200), Bright: f(200)},
+		}, []string{
+			"gap from 1 to 9 between level[0] {min:-32767 max:0 bright:100} and level[1] {min:10 max:100 bright:150}, painted with brightness 16",
+			"level[2] {min:50 max:200 bright:200} overlaps level[1] {min:10 max:100 bright:150}, the one listed first wins",
+		}},
+		// ranges nested in level[0] are measured against its max, not against each other
+		{"nested", []rawLevel{
+			{Min: f(-32767), Max: f(100), Bright: f(100)},
+			{Min: f(10), Max: f(20), Bright: f(120)},
+			{Min: f(50), Max: f(60), Bright: f(130)},
+			{Min: f(150), Max: f(200), Bright: f(140)},
+		}, []string{
+			"level[1] {min:10 max:20 bright:120} overlaps level[0] {min:-32767 max:100 bright:100}, the one listed first wins",
+			"level[2] {min:50 max:60 bright:130} overlaps level[0] {min:-32767 max:100 bright:100}, the one listed first wins",
+			"gap from 101 to 149 between level[0] {min:-32767 max:100 bright:100} and level[3] {min:150 max:200 bright:140}, painted with brightness 16",
+		}},
+		{"darker and low", []rawLevel{
+			{Min: f(0), Max: f(100), Bright: f(150)},
+			{Min: f(101), Max: f(200), Bright: f(140)},
+		}, []string{
+			"brightness goes down from level[0] {min:0 max:100 bright:150} to level[1] {min:101 max:200 bright:140}",
+			"elevation below 0 is not covered by level[0] {min:0 max:100 bright:150}, painted with brightness 16",
+		}},
+		{"missing bounds", []rawLevel{
+			{Min: f(-32767), Bright: f(100)},
+			{Bright: f(150)},
+			{At: f(100), Bright: f(200)},
+		}, []string{
+			"level[0] {min:-32767 max:- bright:100} needs both min and max",
+			"level[1] {min:- max:- bright:150} has neither min/max nor at",
+		}},
+	}
+	for _, tt := range tests {
+		got := levelProblems(tt.levels)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d problems, want %d:\n%q", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: problem %d\n got %q\nwant %q", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLevelCoverage(t *testing.T) {
+	table := []level{
+		{Min: 10, Max: 20, Bright: 100},
+		{Min: 21, Max: 50, Bright: 150},
+	}
+	got := levelCoverage(rampHeightMap(100), table)
+	want := []string{
+		"9 land pixels below 10, the bottom of level[0] {min:10 max:20 bright:100}",
+		"50 land pixels above 50, the top of level[1] {min:21 max:50 bright:150}",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got[i], want[i])
+		}
+	}
+	table[0].Min, table[1].Max = math.MinInt16, math.MaxInt16
+	if got := levelCoverage(rampHeightMap(100), table); len(got) != 0 {
+		t.Errorf("full table: got %q", got)
+	}
+}
+
+func TestConfigLevelTable(t *testing.T) {
+	written := []level{{Min: math.MinInt16, Max: 0, Bright: 0}, {Min: 1, Max: math.MaxInt16, Bright: 255}}
+	if got := configLevelTable(elevation{Level: written}); len(got) != 2 || got[1] != written[1] {
+		t.Errorf("level mode: %v", got)
+	}
+	if got := configLevelTable(elevation{Mode: "Simutrans", Water: 5, Level: written, Simutrans: &simutransLevels{Step: 10, Levels: 3}}); len(got) != 3 || got[0].Max != 5 || got[1].Max != 15 {
+		t.Errorf("simutrans mode: %v", got)
+	}
+	if got := configLevelTable(elevation{Mode: "auto", Level: written}); got != nil {
+		t.Errorf("auto mode: %v, want nil", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
 	"io/ioutil"
 	"log"
@@ -16,6 +17,7 @@ import (
 	"flag"
 	"bytes"
 	"image/png"
+	"path/filepath"
 	"strings"
 )
 
@@ -34,12 +36,15 @@ var margin_style margin
 var area mapRectangle
 var lm largeMap
 var water_is_transparent bool
+var use_ellipsoid bool
+var color_mode colorMode
 
 type drawing int8
 
 const (
 	Degree drawing = iota
 	Mercator
+	Compressed
 )
 
 type margin int8
@@ -49,6 +54,15 @@ const (
 	Water
 )
 
+// colorMode is how the brightness of a level is written to the image. Gray is the 8-bit grey heightmap
+// Simutrans reads, DebugColor paints land green and water blue.
+type colorMode int8
+
+const (
+	Gray colorMode = iota
+	DebugColor
+)
+
 type mapRectangle struct {
 	North float64
 	East  float64
@@ -56,19 +70,37 @@ type mapRectangle struct {
 	South float64
 }
 type level struct {
-	Max    int16
-	Min    int16
-	Bright uint8
+	Min    int16    `json:"min"`
+	Max    int16    `json:"max"`
+	Bright uint8    `json:"bright"`
+	At     *float64 `json:"at,omitempty"`
 }
 type elevation struct {
-	Water int16
-	Level []level
+	Water     int16           `json:"water"`
+	Level     []level         `json:"level"`
+	Mode      string          `json:"mode,omitempty"`
+	Interpolation string      `json:"interpolation,omitempty"`
+	Simutrans *simutransLevels `json:"simutrans,omitempty"`
+	Auto      *autoLevels     `json:"auto,omitempty"`
+	Strict    bool            `json:"strict,omitempty"`
+	Slopelimit *slopeLimit    `json:"slopelimit,omitempty"`
+	Filters   []elevationFilter `json:"filters,omitempty"`
+	Hydrology *hydrology      `json:"hydrology,omitempty"`
+	Transform *elevationTransform `json:"transform,omitempty"`
 }
 type drawingStruct struct {
 	Style     string
 	Pixelsize float64
 	Baselat   float64
 	Margin    string
+	Ellipsoid bool
+	Focus     []focusPoint
+	Resampling string
+	Downsampling string
+	Watercoverage float64
+	Shoreramp float64
+	Watermask *waterMask
+	Color     string
 }
 type jsonData struct {
 	Area      mapRectangle
@@ -76,6 +108,8 @@ type jsonData struct {
 	Filename  string
 	Drawing   drawingStruct
 	WaterIsTransparent bool
+	Export    []elevationExport
+	Worldfile bool
 }
 type elevationData struct {
 	data     []int16
@@ -92,20 +126,24 @@ type cell struct {
 }
 type largeMap struct {
 	domain mapRectangle
-	data   *image.RGBA
+	data   draw.Image
 }
 
 func newLargeMap(domain mapRectangle, width, height int) largeMap {
 	var lm largeMap
 	lm.domain = domain
 
-	lm.data = image.NewRGBA(image.Rect(0, 0, width, height))
+	if color_mode == DebugColor {
+		lm.data = image.NewRGBA(image.Rect(0, 0, width, height))
+	} else {
+		lm.data = image.NewGray(image.Rect(0, 0, width, height))
+	}
 	return lm
 }
 
 func saveImage(data image.Image, filename string) {
 
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0666)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -115,6 +153,14 @@ func saveImage(data image.Image, filename string) {
 	}
 }
 func (lm *largeMap) SaveImageLarge(filename string) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".bmp":
+		saveBMP(toGray(lm.data), filename)
+		return
+	case ".tif", ".tiff":
+		saveGeoTIFF(toGray(lm.data), filename)
+		return
+	}
 	saveImage(lm.data, filename)
 }
 func FileExists(filename string) bool {
@@ -122,16 +168,30 @@ func FileExists(filename string) bool {
 	return err == nil
 }
 
-func elevationToColor(elevation int16) color.RGBA {
+// levelBright returns the brightness of elevation in the level table.
+func levelBright(elevation int16) uint8 {
 
 	var num uint8 = 16
 
-	for _, level := range elevation_level {
-		if elevation >= level.Min && elevation <= level.Max {
-			num = level.Bright
-			break
+	if level_interpolation != Stepped && len(level_anchors) > 0 {
+		num = rampBright(elevation)
+	} else {
+		for _, level := range elevation_level {
+			if elevation >= level.Min && elevation <= level.Max {
+				num = level.Bright
+				break
+			}
 		}
 	}
+	return num
+}
+
+func elevationToColor(elevation int16) color.Color {
+
+	num := levelBright(elevation)
+	if color_mode == Gray {
+		return color.Gray{num}
+	}
 
 	if elevation <= water_level {
 		if water_is_transparent {
@@ -254,65 +314,46 @@ func Download(lat int16, lon int16, dryrun bool) (elevationData, []byte) {
 
 	var elevation int16
 	cellElevationData.received = true
+	useTiles(filename_hgt_zipped, filename_swbd_zipped)
 	hgtBuf := bytes.NewReader(hgtData)
 	for y := 0; y < CELL_SIZE; y++ {
 		for x := 0; x < CELL_SIZE; x++ {
 			binary.Read(hgtBuf, binary.BigEndian, &elevation)
-			if swbdExists && swbdData[(y*3)*CELL_SWBD_SIZE+(x*3)] == 0xff {
-				elevation = water_level
-			}
 			cellElevationData.data[y*cellElevationData.width+x] = elevation
 		}
 	}
 	return cellElevationData, swbdData
 
 }
-func degreeMap(dryrun bool) {
-	var mapDomain mapRectangle = area
-	var width int = int(math.Floor((mapDomain.East - mapDomain.West) * float64(CELL_SIZE)))
-	var height int = int(math.Floor((mapDomain.North - mapDomain.South) * float64(CELL_SIZE)))
-	lm = newLargeMap(area, width, height)
-
-	for lat := int16(math.Floor(mapDomain.South)); float64(lat) < mapDomain.North; lat++ {
-		for lon := int16(math.Floor(mapDomain.West)); float64(lon) < mapDomain.East; lon++ {
-			elevationData, _ := Download(lat, lon, dryrun)
-			if dryrun {
-				continue
-			}
+func degreeMap(pixelsize float64, base_lat float64, dryrun bool) *heightMap {
+	ep := newEquirectangularProjection(pixelsize, base_lat)
+	println("Degree width,height:", ep.width, ep.height)
+	return renderMap(ep, dryrun)
+}
 
-			var x_offset int = int(math.Floor((float64(elevationData.lon) - mapDomain.West) * float64(CELL_SIZE)))
-			var y_offset int = int(math.Floor((mapDomain.North - float64(elevationData.lat) - 1) * float64(CELL_SIZE)))
-			var x, y int
-			for y = 0; y < CELL_SIZE; y++ {
-				if y_offset+y < 0 {
-					y = -y_offset
-				} else if y_offset+y > height {
-					break
-				}
-				for x = 0; x < CELL_SIZE; x++ {
-					if x_offset+x < 0 {
-						x = -x_offset
-					} else if x_offset+x > width {
-						break
-					}
-					var elevation int16
-
-					if elevationData.received {
-						elevation = elevationData.data[y*elevationData.width+x]
-					} else {
-						elevation = math.MinInt16
-					}
-					cl := elevationToColor(elevation)
-					(lm.data).SetRGBA(int(x_offset+x), int(y_offset+y), cl)
-				}
-			}
-		}
+// newEquirectangularProjection returns the Degree projection of area with pixels of pixelsize metres at base_lat.
+func newEquirectangularProjection(pixelsize float64, base_lat float64) equirectangularProjection {
+	base_lat = areaBaseLat(base_lat)
+	// metres per degree of latitude; one SRTM sample is 1/CELL_DIV of this
+	degree_length := EARTH_RADIUS * math.Pi / 180
+	if pixelsize <= 0 {
+		pixelsize = degree_length / float64(CELL_DIV)
 	}
-}
-func bilinearElevation(O_value, X_value, Y_value, XY_value int16, dx, dy float64) int16 {
-	return int16(math.Floor(0.5 + (1-dy)*((1-dx)*float64(O_value)+dx*float64(X_value)) + dy*((1-dx)*float64(Y_value)+dx*float64(XY_value))))
+
+	// pixels per degree. Longitude is shrunk by cos(baselat) so that pixels are square on the ground at baselat
+	var ep equirectangularProjection
+	real_length_width := degree_length * math.Cos(base_lat*math.Pi/180) * (area.East - area.West)
+	ep.scale_x = math.Floor(0.5+real_length_width/pixelsize) / (area.East - area.West)
+	ep.scale_y = ep.scale_x / math.Cos(base_lat*math.Pi/180)
+	ep.width = int(math.Floor(0.5 + (area.East-area.West)*ep.scale_x))
+	ep.height = int(math.Floor(0.5 + (area.North-area.South)*ep.scale_y))
+	return ep
 }
 func latToW(deg float64) float64 {
+	if use_ellipsoid {
+		sin := math.Sin(deg * math.Pi / 180)
+		return math.Atanh(sin) - EARTH_ECCENTRICITY*math.Atanh(EARTH_ECCENTRICITY*sin)
+	}
 	return math.Atanh(math.Sin(deg * math.Pi / 180))
 }
 func lonToV(deg float64) float64 {
@@ -322,8 +363,40 @@ func vToLon(x float64) float64 {
 	return 180 / math.Pi * x
 }
 func wToLat(y float64) float64 {
+	if use_ellipsoid {
+		// fixed point iteration, converges to below 1e-12 rad within a few steps
+		phi := math.Asin(math.Tanh(y))
+		for i := 0; i < 20; i++ {
+			next := math.Asin(math.Tanh(y + EARTH_ECCENTRICITY*math.Atanh(EARTH_ECCENTRICITY*math.Sin(phi))))
+			if math.Abs(next-phi) < 1e-12 {
+				phi = next
+				break
+			}
+			phi = next
+		}
+		return phi * 180 / math.Pi
+	}
 	return math.Asin(math.Tanh(y)) * 180 / math.Pi
 }
+
+// parallelRadius returns the radius of the parallel at deg, i.e. metres per radian of longitude.
+func parallelRadius(deg float64) float64 {
+	phi := deg * math.Pi / 180
+	if use_ellipsoid {
+		sin := EARTH_ECCENTRICITY * math.Sin(phi)
+		return EARTH_RADIUS * math.Cos(phi) / math.Sqrt(1-sin*sin)
+	}
+	return EARTH_RADIUS * math.Cos(phi)
+}
+
+// meridianRadius returns the radius of curvature of the meridian at deg, i.e. metres per radian of latitude.
+func meridianRadius(deg float64) float64 {
+	if use_ellipsoid {
+		sin := EARTH_ECCENTRICITY * math.Sin(deg*math.Pi/180)
+		return EARTH_RADIUS * (1 - EARTH_ECCENTRICITY*EARTH_ECCENTRICITY) / math.Pow(1-sin*sin, 1.5)
+	}
+	return EARTH_RADIUS
+}
 func intMin(a, b int) int {
 	if a > b {
 		return b
@@ -338,111 +411,82 @@ func intMax(a, b int) int {
 }
 
 
-func mercatorMap(pixelsize float64, base_lat float64, dryrun bool) {
-
-	var mapDomain mapRectangle = area
+// mercatorScale returns the number of pixels per unit of the Mercator plane
+// so that a pixel is pixelsize metres wide at base_lat.
+func mercatorScale(pixelsize float64, base_lat float64) float64 {
 	dv := lonToV(area.East) - lonToV(area.West)
-	dw := latToW(area.North) - latToW(area.South)
-	//	image_v_west := lonToV(area.West)
-	//	image_w_north := latToW(area.North)
-	if base_lat < area.South || base_lat > area.North {
-		base_lat = (area.South + area.North) / 2
-	}
+	real_length_width := parallelRadius(areaBaseLat(base_lat)) * dv
+	return math.Floor(0.5+real_length_width/pixelsize) / dv
+}
 
-	real_length_width := EARTH_RADIUS * math.Cos(base_lat*math.Pi/180) * ((area.East - area.West) * math.Pi / 180)
-	scale := math.Floor(0.5+real_length_width/pixelsize) / dv
-	width := int(math.Floor(0.5 + dv*scale))
-	height := int(math.Floor(0.5 + dw*scale))
+// reportMercatorPixelsize prints the size of a pixel of a Mercator map of scale at base_lat and at both edges.
+// The width is rounded to whole pixels, so the scale actually used differs slightly from pixelsize.
+func reportMercatorPixelsize(scale float64, base_lat float64) {
+	base_lat = areaBaseLat(base_lat)
+	fmt.Printf("Mercator true pixelsize: %.3fm at baselat %.4f, %.3fm at north edge, %.3fm at south edge (ellipsoid: %t)\n",
+		parallelRadius(base_lat)/scale, base_lat, parallelRadius(area.North)/scale, parallelRadius(area.South)/scale, use_ellipsoid)
+}
 
-	println("Mercator width,height:",width, height)
-	lm = newLargeMap(area, width, height)
+// areaBaseLat returns base_lat, or the middle of the area when base_lat is outside it.
+func areaBaseLat(base_lat float64) float64 {
+	if base_lat < area.South || base_lat > area.North {
+		return (area.South + area.North) / 2
+	}
+	return base_lat
+}
 
-	for lat := int16(math.Floor(mapDomain.South)); float64(lat) < mapDomain.North; lat++ {
-		for lon := int16(math.Floor(mapDomain.West)); float64(lon) < mapDomain.East; lon++ {
-			elevationData, swbdData := Download(lat, lon, dryrun)
-			
-			if dryrun {
-				continue
-			}
+// normalizeArea checks the area read from a config and moves East past 180 degrees for maps that cross
+// the antimeridian, so that East is always greater than West.
+func normalizeArea() {
+	if area.North < area.South {
+		fmt.Println("North lat is more south than South lat.")
+		os.Exit(1)
+	}
+	if area.East < area.West {
+		area.East += 360
+	}
+}
 
-			cell_lon_west := math.Max(float64(lon), area.West)
-			cell_lon_east := math.Min(float64(lon+1), area.East)
-			cell_lat_north := math.Min(float64(lat+1), area.North)
-			cell_lat_south := math.Max(float64(lat), area.South)
-
-			// x and y are coordinate on output image
-			pixel_x_offset := int( math.Ceil( (lonToV(cell_lon_west) - lonToV(area.West)) * scale) )
-			pixel_x_max := int((lonToV(cell_lon_east) - lonToV(area.West)) * scale)
-			pixel_y_offset := int(math.Ceil( (latToW(area.North) - latToW(cell_lat_north)) * scale) )
-			pixel_y_max := int(((latToW(area.North) - latToW(cell_lat_south)) * scale) )
-			println("Cell:x", pixel_x_offset, pixel_x_max, "y", pixel_y_offset, pixel_y_max)
-			var pixel_lon_decimal, pixel_lat_decimal, cell_O_lon_decimal, cell_O_lat_decimal, cell_dx, cell_dy float64
-			var cell_O_x, cell_O_y, cell_X_x, cell_Y_y int
-			var cell_swbd_x, cell_swbd_y int
-			var elevation_O, elevation_X, elevation_Y, elevation_XY, elevation int16
-
-			for pixel_y := pixel_y_offset; pixel_y <= pixel_y_max; pixel_y++ {
-				for pixel_x := pixel_x_offset; pixel_x <= pixel_x_max; pixel_x++ {
-
-					if elevationData.received == true {
-						pixel_lon_decimal = vToLon(float64(pixel_x)/scale)+area.West - math.Floor(cell_lon_west)
-						pixel_lat_decimal = wToLat(latToW(area.North)-float64(pixel_y)/scale) - math.Floor(cell_lat_south)
-
-						if pixel_lat_decimal > 1 {
-
-							continue
-						}
-						if pixel_lon_decimal > 1{
-
-							continue
-						}
-						//water or land
-						cell_swbd_x = int(pixel_lon_decimal * float64(CELL_SWBD_DIV))
-						cell_swbd_y = int((1 - pixel_lat_decimal) * float64(CELL_SWBD_DIV))
-						if swbdData[cell_swbd_y*CELL_SWBD_SIZE+cell_swbd_x] == 0xff {
-							elevation = water_level
-						} else {
-							//elevation
-							cell_O_x = int(pixel_lon_decimal * float64(CELL_DIV))
-							cell_O_y = int((1 - pixel_lat_decimal) * float64(CELL_DIV))
-							cell_O_lon_decimal = float64(cell_O_x) / float64(CELL_DIV)
-							cell_O_lat_decimal = (1 - float64(cell_O_y)/float64(CELL_DIV))
-							cell_dx = (pixel_lon_decimal - cell_O_lon_decimal) * float64(CELL_DIV) // lower than 1
-							cell_dy = (pixel_lat_decimal - cell_O_lat_decimal) * float64(CELL_DIV)
-
-							if cell_dx == 0 {
-								cell_X_x = cell_O_x
-							} else {
-								cell_X_x = cell_O_x + 1
-							}
-							if cell_dy == 0 {
-								cell_Y_y = cell_O_y
-							} else {
-								cell_Y_y = cell_O_y + 1
-							}
-
-							elevation_O = elevationData.data[cell_O_y*CELL_SIZE+cell_O_x]
-							elevation_X = elevationData.data[cell_O_y*CELL_SIZE+cell_X_x]
-							elevation_Y = elevationData.data[cell_Y_y*CELL_SIZE+cell_O_x]
-							elevation_XY = elevationData.data[cell_Y_y*CELL_SIZE+cell_X_x]
-							elevation = bilinearElevation(elevation_O, elevation_X, elevation_Y, elevation_XY, cell_dx, cell_dy)
-						}
-
-					} else {
-						elevation = math.MinInt16
-					}
-
-					cl := elevationToColor(elevation)
-					(lm.data).SetRGBA(pixel_x, pixel_y, cl)
-
-				}
+func mercatorMap(pixelsize float64, base_lat float64, dryrun bool) *heightMap {
+	mp := newMercatorProjection(pixelsize, base_lat)
+	reportMercatorPixelsize(mp.scale, base_lat)
+	println("Mercator width,height:", mp.width, mp.height)
+	return renderMap(mp, dryrun)
+}
 
-			}
-		}
-	}
+// newMercatorProjection returns the Mercator projection of area with pixels of pixelsize metres at base_lat.
+func newMercatorProjection(pixelsize float64, base_lat float64) mercatorProjection {
+	var mp mercatorProjection
+	dv := lonToV(area.East) - lonToV(area.West)
+	dw := latToW(area.North) - latToW(area.South)
+	mp.v_west = lonToV(area.West)
+	mp.w_north = latToW(area.North)
 
+	mp.scale = mercatorScale(pixelsize, base_lat)
+	mp.width = int(math.Floor(0.5 + dv*mp.scale))
+	mp.height = int(math.Floor(0.5 + dw*mp.scale))
+	return mp
 }
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bmp":
+			bmpCommand(os.Args[2:])
+			return
+		case "coords":
+			coordsCommand(os.Args[2:])
+			return
+		case "places":
+			placesCommand(os.Args[2:])
+			return
+		case "scenario":
+			scenarioCommand(os.Args[2:])
+			return
+		case "routes":
+			routesCommand(os.Args[2:])
+			return
+		}
+	}
 	dryrun := flag.Bool("d", false, "check files")
 	filename := flag.String("f", "default.json", "filename")
 	flag.Parse()
@@ -459,6 +503,8 @@ func main() {
 	if err != nil{
 		log.Fatalln(err)
 	}
+	// checked before Unmarshal, which would stop at the first brightness outside uint8
+	validateLevels(json_file)
 	err = json.Unmarshal(json_file,&jsonIn)
 	if err != nil{
 		log.Fatalln(err)
@@ -466,9 +512,33 @@ func main() {
 
 	area = jsonIn.Area
 
-	elevation_level = jsonIn.Elevation.Level // global
+	elevation_level = configLevelTable(jsonIn.Elevation) // global
 	water_level = jsonIn.Elevation.Water     //global
+	switch strings.ToLower(jsonIn.Elevation.Interpolation) {
+	case "linear":
+		level_interpolation = LinearRamp
+	case "smoothstep":
+		level_interpolation = SmoothRamp
+	default:
+		level_interpolation = Stepped
+	}
+	if strings.ToLower(jsonIn.Elevation.Mode) == "auto" && jsonIn.Elevation.Auto == nil {
+		jsonIn.Elevation.Auto = &autoLevels{}
+	}
 	water_is_transparent = jsonIn.WaterIsTransparent // global
+	switch strings.ToLower(jsonIn.Drawing.Color) {
+	case "gray", "grey", "":
+		color_mode = Gray
+	case "debug":
+		color_mode = DebugColor
+	default:
+		log.Fatalf("drawing.color must be gray or debug, got %q\n", jsonIn.Drawing.Color)
+	}
+	if color_mode == Gray && water_is_transparent {
+		// a heightmap is read by its grey values, so the grey PNG stays image.Gray
+		fmt.Println("water_is_transparent is only used with drawing.color debug, ignored")
+	}
+	use_ellipsoid = jsonIn.Drawing.Ellipsoid         // global
 
 	margin_type_string := strings.ToLower(jsonIn.Drawing.Margin)
 	switch margin_type_string {
@@ -480,25 +550,82 @@ func main() {
 		margin_style = Water
 	}
 
-	if area.North < area.South {
-		fmt.Println("North lat is more south than South lat.")
-		os.Exit(1)
+	resampling_type_string := strings.ToLower(jsonIn.Drawing.Resampling)
+	switch resampling_type_string {
+	case "nearest":
+		resampling_style = Nearest
+	case "bicubic":
+		resampling_style = Bicubic
+	case "lanczos":
+		resampling_style = Lanczos
+	default:
+		resampling_style = Bilinear
 	}
-	if area.East < area.West {
-		area.East += 360
+
+	downsampling_type_string := strings.ToLower(jsonIn.Drawing.Downsampling)
+	switch downsampling_type_string {
+	case "box":
+		downsampling_style = BoxFilter
+	case "gaussian":
+		downsampling_style = GaussianFilter
+	default:
+		downsampling_style = PointSampling
 	}
+	if jsonIn.Drawing.Watercoverage > 0 {
+		water_coverage = jsonIn.Drawing.Watercoverage
+	}
+
+	normalizeArea()
+	var hm *heightMap
 	drawing_type_string := strings.ToLower(jsonIn.Drawing.Style)
 	switch drawing_type_string {
 	case "mercator":
 		drawing_style = Mercator
-		mercatorMap(jsonIn.Drawing.Pixelsize, jsonIn.Drawing.Baselat, *dryrun)
+		hm = mercatorMap(jsonIn.Drawing.Pixelsize, jsonIn.Drawing.Baselat, *dryrun)
+	case "compressed":
+		drawing_style = Compressed
+		hm = compressedMap(jsonIn.Drawing.Pixelsize, jsonIn.Drawing.Baselat, jsonIn.Drawing.Focus, *dryrun)
 	case "degree":
 		drawing_style = Degree
-		degreeMap(*dryrun)
+		hm = degreeMap(jsonIn.Drawing.Pixelsize, jsonIn.Drawing.Baselat, *dryrun)
 	default:
 		drawing_style = Degree
-		degreeMap(*dryrun)
+		hm = degreeMap(jsonIn.Drawing.Pixelsize, jsonIn.Drawing.Baselat, *dryrun)
+	}
+	if *dryrun {
+		return
 	}
 
+	if jsonIn.Drawing.Watermask != nil {
+		hm.cleanWater(*jsonIn.Drawing.Watermask)
+	}
+	if len(jsonIn.Elevation.Filters) > 0 {
+		hm.filterElevation(jsonIn.Elevation.Filters, map_projection)
+	}
+	if jsonIn.Drawing.Shoreramp > 0 {
+		hm.shoreRamp(jsonIn.Drawing.Shoreramp)
+	}
+	if jsonIn.Elevation.Hydrology != nil {
+		hm.conditionHydrology(*jsonIn.Elevation.Hydrology)
+	}
+	if jsonIn.Elevation.Transform != nil {
+		hm.transformElevation(*jsonIn.Elevation.Transform)
+	}
+	exportElevation(hm, jsonIn.Export, jsonIn.Worldfile)
+	if jsonIn.Elevation.Auto != nil && strings.ToLower(jsonIn.Elevation.Mode) == "auto" {
+		elevation_level = autoLevelTable(hm, *jsonIn.Elevation.Auto, water_level)
+		if jsonIn.Elevation.Auto.Output != "" {
+			saveLevelTable(elevation_level, water_level, jsonIn.Elevation.Auto.Output)
+		}
+	}
+	if jsonIn.Elevation.Slopelimit != nil {
+		hm.limitSlope(*jsonIn.Elevation.Slopelimit)
+	}
+	checkLevelCoverage(hm, elevation_level, jsonIn.Elevation.Strict)
+	paintMap(hm)
 	lm.SaveImageLarge(jsonIn.Filename)
+	saveMetadata(jsonIn.Filename, hm, jsonIn.Drawing.Baselat)
+	if jsonIn.Worldfile {
+		saveWorldFile(jsonIn.Filename)
+	}
 }
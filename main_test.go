@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLatToWRoundTrip(t *testing.T) {
+	defer func(e bool) { use_ellipsoid = e }(use_ellipsoid)
+	for _, ellipsoid := range []bool{false, true} {
+		use_ellipsoid = ellipsoid
+		for _, lat := range []float64{-85, -60, -35.5, -1e-6, 0, 1e-6, 24.3, 35, 51.5, 66.6, 85} {
+			if got := wToLat(latToW(lat)); math.Abs(got-lat) > 1e-9 {
+				t.Errorf("ellipsoid %t: wToLat(latToW(%g)) = %.12f", ellipsoid, lat, got)
+			}
+		}
+	}
+}
+
+func TestLatToW(t *testing.T) {
+	defer func(e bool) { use_ellipsoid = e }(use_ellipsoid)
+	tests := []struct {
+		ellipsoid bool
+		lat       float64
+		w         float64
+	}{
+		{false, 0, 0},
+		{true, 0, 0},
+		// ln(tan(45 + lat/2)) on the sphere
+		{false, 45, math.Log(math.Tan(math.Pi/4 + math.Pi/8))},
+		{false, -30, -math.Log(math.Tan(math.Pi/4 + math.Pi/12))},
+		// the ellipsoid shrinks the Mercator ordinate: 3395 northing / a at 45 degrees
+		{true, 45, 5591295.9185 / 6378137},
+	}
+	for _, tt := range tests {
+		use_ellipsoid = tt.ellipsoid
+		if got := latToW(tt.lat); math.Abs(got-tt.w) > 1e-9 {
+			t.Errorf("ellipsoid %t: latToW(%g) = %.12f, want %.12f", tt.ellipsoid, tt.lat, got, tt.w)
+		}
+	}
+}
+
+func TestParallelRadius(t *testing.T) {
+	defer func(e bool) { use_ellipsoid = e }(use_ellipsoid)
+	use_ellipsoid = false
+	if got := parallelRadius(60); math.Abs(got-EARTH_RADIUS/2) > 1e-6 {
+		t.Errorf("sphere: parallelRadius(60) = %f, want %f", got, EARTH_RADIUS/2)
+	}
+	use_ellipsoid = true
+	if got := parallelRadius(0); got != EARTH_RADIUS {
+		t.Errorf("ellipsoid: parallelRadius(0) = %f, want the equatorial radius", got)
+	}
+	// the ellipsoid is flattened, so parallels are longer than on the sphere of the equatorial radius
+	if got := parallelRadius(60); got <= EARTH_RADIUS/2 {
+		t.Errorf("ellipsoid: parallelRadius(60) = %f, want more than %f", got, EARTH_RADIUS/2)
+	}
+}
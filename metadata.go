@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// version is the version of simumap written into the metadata, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// used_tiles lists the zipped SRTM and SWBD files read by Download, once each in the order they were first read.
+// The sampler releases cells and may read them again, so used_tile_set keeps track of the files already listed.
+var used_tiles []string
+var used_tile_set = make(map[string]bool)
+
+// useTiles adds the files to used_tiles unless they are listed already.
+func useTiles(filenames ...string) {
+	for _, f := range filenames {
+		if !used_tile_set[f] {
+			used_tile_set[f] = true
+			used_tiles = append(used_tiles, f)
+		}
+	}
+}
+
+// renderMetadata is the sidecar written next to the output, so that scripts can convert between pixels and
+// latitude/longitude without repeating the rounding of the projections.
+type renderMetadata struct {
+	Simumap       string                    `json:"simumap"`
+	Image         metadataImage             `json:"image"`
+	Area          mapRectangle              `json:"area"`
+	Projection    metadataProjection        `json:"projection"`
+	Pixelsize     []metadataPixelsize       `json:"pixelsize"`
+	Affine        *metadataAffine           `json:"affine,omitempty"`
+	Corners       map[string]metadataLatLon `json:"corners"`
+	Tiles         []metadataTile            `json:"tiles"`
+	Water         int16                     `json:"water"`
+	Level         []level                   `json:"level"`
+	Interpolation string                    `json:"interpolation"`
+}
+
+type metadataImage struct {
+	Filename string `json:"filename"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Color    string `json:"color"`
+}
+
+// metadataProjection holds the parameters of the projection as used, after rounding to whole pixels.
+// Formula describes how pixel (x, y), centred on the returned point, maps to latitude and longitude.
+type metadataProjection struct {
+	Style     string          `json:"style"`
+	Ellipsoid bool            `json:"ellipsoid"`
+	Formula   string          `json:"formula"`
+	Scale_x   float64         `json:"scale_x"`
+	Scale_y   float64         `json:"scale_y"`
+	Scale     float64         `json:"scale"`
+	V_west    float64         `json:"v_west"`
+	W_north   float64         `json:"w_north"`
+	Offset_x  float64         `json:"offset_x"`
+	Offset_y  float64         `json:"offset_y"`
+	Stages    []metadataStage `json:"stages,omitempty"`
+}
+
+type metadataStage struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Weight float64 `json:"weight"`
+	Radius float64 `json:"radius"`
+}
+
+// metadataPixelsize is the east-west size of a pixel on the ground at a latitude, in metres.
+type metadataPixelsize struct {
+	Where  string  `json:"where"`
+	Lat    float64 `json:"lat"`
+	Metres float64 `json:"metres"`
+}
+
+// metadataAffine is the GDAL geotransform of pixel corners in the reference system EPSG.
+type metadataAffine struct {
+	EPSG      int        `json:"epsg"`
+	Transform [6]float64 `json:"transform"`
+}
+
+type metadataLatLon struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type metadataTile struct {
+	Filename string `json:"filename"`
+	Sha256   string `json:"sha256"`
+}
+
+// projectionMetadata describes proj with all the parameters needed to rebuild it.
+func projectionMetadata(proj projection) metadataProjection {
+	var mp metadataProjection
+	mp.Ellipsoid = use_ellipsoid
+	mercator := "lat = wToLat(w_north - y/scale), lon = degrees(x/scale + v_west), wToLat the inverse of w = atanh(sin(lat))"
+	if use_ellipsoid {
+		mercator += " - e*atanh(e*sin(lat)) with e = " + fmt.Sprint(EARTH_ECCENTRICITY)
+	}
+	switch p := proj.(type) {
+	case equirectangularProjection:
+		mp.Style = "Degree"
+		mp.Scale_x, mp.Scale_y = p.scale_x, p.scale_y
+		mp.Formula = "lat = north - y/scale_y, lon = west + x/scale_x"
+	case mercatorProjection:
+		mp.Style = "Mercator"
+		mp.Scale, mp.V_west, mp.W_north = p.scale, p.v_west, p.w_north
+		mp.Formula = mercator
+	case compressedMercator:
+		mp.Style = "Compressed"
+		mp.Scale, mp.V_west, mp.W_north = p.scale, p.v_west, p.w_north
+		mp.Offset_x, mp.Offset_y = p.offset_x, p.offset_y
+		for _, st := range p.stages {
+			mp.Stages = append(mp.Stages, metadataStage{st.x, st.y, st.weight, st.radius})
+		}
+		mp.Formula = "add offset_x and offset_y to (x, y), undo the stages from the last to the first, then " + mercator +
+			". A stage moves a point at distance r from (x, y) to r + weight*radius*F(r/radius), F(t) = t - 2t^3/3 + t^5/5 for t < 1, 8/15 beyond"
+	}
+	return mp
+}
+
+// fileSha256 returns the SHA-256 of a file in hex.
+func fileSha256(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		log.Fatalln(err)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readMetadata reads a sidecar written by saveMetadata.
+func readMetadata(filename string) renderMetadata {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var md renderMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		log.Fatalln(err)
+	}
+	return md
+}
+
+// saveMetadata writes the sidecar of the output filename as <name>.meta.json.
+func saveMetadata(filename string, hm *heightMap, base_lat float64) {
+	var md renderMetadata
+	md.Simumap = version
+	md.Image = metadataImage{Filename: filepath.Base(filename), Width: hm.width, Height: hm.height, Color: "gray"}
+	if color_mode == DebugColor {
+		md.Image.Color = "debug"
+	}
+	md.Area = area
+	md.Projection = projectionMetadata(map_projection)
+
+	base_lat = areaBaseLat(base_lat)
+	center_lon := (area.East + area.West) / 2
+	for _, p := range []struct {
+		where string
+		lat   float64
+	}{{"baselat", base_lat}, {"north", area.North}, {"south", area.South}} {
+		x, y := map_projection.latLonToPixel(p.lat, center_lon)
+		_, west := map_projection.pixelToLatLon(x-0.5, y)
+		_, east := map_projection.pixelToLatLon(x+0.5, y)
+		md.Pixelsize = append(md.Pixelsize, metadataPixelsize{p.where, p.lat, parallelRadius(p.lat) * (east - west) * math.Pi / 180})
+	}
+
+	if transform, epsg, ok := geoTransform(map_projection); ok {
+		md.Affine = &metadataAffine{epsg, transform}
+	}
+	// outer corners of the corner pixels
+	md.Corners = make(map[string]metadataLatLon)
+	w, h := float64(hm.width), float64(hm.height)
+	for name, c := range map[string][2]float64{"northwest": {-0.5, -0.5}, "northeast": {w - 0.5, -0.5}, "southwest": {-0.5, h - 0.5}, "southeast": {w - 0.5, h - 0.5}} {
+		lat, lon := map_projection.pixelToLatLon(c[0], c[1])
+		md.Corners[name] = metadataLatLon{lat, lon}
+	}
+
+	for _, tile := range used_tiles {
+		md.Tiles = append(md.Tiles, metadataTile{tile, fileSha256(tile)})
+	}
+	md.Water = water_level
+	md.Level = elevation_level
+	switch level_interpolation {
+	case Stepped:
+		md.Interpolation = "step"
+	case LinearRamp:
+		md.Interpolation = "linear"
+	case SmoothRamp:
+		md.Interpolation = "smoothstep"
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(md); err != nil {
+		log.Fatalln(err)
+	}
+	sidecar := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".meta.json"
+	if err := ioutil.WriteFile(sidecar, buf.Bytes(), 0666); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("metadata:", sidecar)
+}
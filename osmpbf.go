@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// protoReader walks the fields of one protocol buffer message. Only what the OSM PBF format needs is read:
+// varints, length delimited fields and skipping of the fixed size ones. The first decode error is kept in
+// err and ends the message, so callers check err once after their loop.
+type protoReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (pr *protoReader) fail(format string, a ...interface{}) {
+	if pr.err == nil {
+		pr.err = fmt.Errorf("osm pbf: "+format, a...)
+	}
+	pr.pos = len(pr.data)
+}
+
+func (pr *protoReader) varint() uint64 {
+	var v uint64
+	for shift := uint(0); pr.pos < len(pr.data); shift += 7 {
+		if shift >= 64 {
+			pr.fail("varint longer than 64 bits")
+			return 0
+		}
+		b := pr.data[pr.pos]
+		pr.pos++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+	pr.fail("truncated varint")
+	return 0
+}
+
+// next returns the number and wire type of the next field, ok false at the end of the message or after an error.
+func (pr *protoReader) next() (field int, wire int, ok bool) {
+	if pr.err != nil || pr.pos >= len(pr.data) {
+		return 0, 0, false
+	}
+	key := pr.varint()
+	return int(key >> 3), int(key & 7), pr.err == nil
+}
+
+func (pr *protoReader) bytes() []byte {
+	n := pr.varint()
+	if pr.err != nil {
+		return nil
+	}
+	if n > uint64(len(pr.data)-pr.pos) {
+		pr.fail("truncated field of %d bytes", n)
+		return nil
+	}
+	b := pr.data[pr.pos : pr.pos+int(n)]
+	pr.pos += int(n)
+	return b
+}
+
+func (pr *protoReader) skip(wire int) {
+	fixed := 0
+	switch wire {
+	case 0:
+		pr.varint()
+	case 1:
+		fixed = 8
+	case 2:
+		pr.bytes()
+	case 5:
+		fixed = 4
+	default:
+		pr.fail("unsupported wire type %d", wire)
+	}
+	if fixed > len(pr.data)-pr.pos {
+		pr.fail("truncated fixed field")
+		return
+	}
+	pr.pos += fixed
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// packed returns the varints of a packed repeated field.
+func packed(data []byte) ([]uint64, error) {
+	pr := protoReader{data: data}
+	var values []uint64
+	for pr.pos < len(pr.data) {
+		values = append(values, pr.varint())
+	}
+	return values, pr.err
+}
+
+// osmWay is a way of an OSM extract with its tags and the positions of the nodes that were kept.
+// A nil position is a node outside the region that was read.
+type osmWay struct {
+	tags  map[string]string
+	nodes []*[2]float64
+}
+
+// osm_max_header and osm_max_blob are the largest BlobHeader and Blob the OSM PBF format allows.
+const (
+	osm_max_header = 64 * 1024
+	osm_max_blob   = 32 * 1024 * 1024
+)
+
+// osmReader collects the nodes inside region and the ways for which keep returns true while the blocks
+// of an extract are decoded.
+type osmReader struct {
+	region     mapRectangle
+	keep       func(tags map[string]string) bool
+	nodes      map[int64][2]float64
+	ways       []osmWay
+	node_count int
+	way_count  int
+}
+
+// readOSMPBF reads the ways of an OSM PBF extract for which keep returns true, with the positions of their
+// nodes inside region. Nodes are expected before ways, as in the extracts written by osmium and osmosis.
+// A truncated or malformed file gives an error instead of a partial result.
+func readOSMPBF(filename string, region mapRectangle, keep func(tags map[string]string) bool) ([]osmWay, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	osm := osmReader{region: region, keep: keep, nodes: make(map[int64][2]float64)}
+
+	for block := 0; ; block++ {
+		blob_type, data, err := readOSMBlob(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: block %d: %v", filename, block, err)
+		}
+		if blob_type != "OSMData" {
+			continue
+		}
+		if err := osm.primitiveBlock(data); err != nil {
+			return nil, fmt.Errorf("%s: block %d: %v", filename, block, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d nodes, %d ways read, %d nodes in the map, %d ways kept\n",
+		filename, osm.node_count, osm.way_count, len(osm.nodes), len(osm.ways))
+	return osm.ways, nil
+}
+
+// readOSMBlob reads the next BlobHeader and Blob and returns the type and the uncompressed content.
+// It returns io.EOF only at the end of the file between two blobs.
+func readOSMBlob(r io.Reader) (string, []byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return "", nil, errors.New("osm pbf: truncated header size")
+		}
+		return "", nil, err
+	}
+	if size > osm_max_header {
+		return "", nil, fmt.Errorf("osm pbf: header of %d bytes", size)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, fmt.Errorf("osm pbf: header: %v", err)
+	}
+	var blob_type string
+	var blob_size uint64
+	hr := protoReader{data: header}
+	for field, wire, ok := hr.next(); ok; field, wire, ok = hr.next() {
+		switch field {
+		case 1:
+			blob_type = string(hr.bytes())
+		case 3:
+			blob_size = hr.varint()
+		default:
+			hr.skip(wire)
+		}
+	}
+	if hr.err != nil {
+		return "", nil, hr.err
+	}
+	if blob_size > osm_max_blob {
+		return "", nil, fmt.Errorf("osm pbf: blob of %d bytes", blob_size)
+	}
+	blob := make([]byte, blob_size)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return "", nil, fmt.Errorf("osm pbf: blob: %v", err)
+	}
+	if blob_type != "OSMData" {
+		return blob_type, nil, nil
+	}
+
+	var data []byte
+	br := protoReader{data: blob}
+	for field, wire, ok := br.next(); ok; field, wire, ok = br.next() {
+		switch field {
+		case 1: // raw
+			data = br.bytes()
+		case 3: // zlib_data
+			compressed := br.bytes()
+			if br.err != nil {
+				break
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				return "", nil, fmt.Errorf("osm pbf: %v", err)
+			}
+			if data, err = ioutil.ReadAll(io.LimitReader(zr, osm_max_blob+1)); err != nil {
+				return "", nil, fmt.Errorf("osm pbf: %v", err)
+			}
+			if len(data) > osm_max_blob {
+				return "", nil, errors.New("osm pbf: uncompressed blob larger than 32 MiB")
+			}
+		case 4, 5, 6, 7:
+			return "", nil, errors.New("osm pbf: only raw and zlib compressed blobs are supported")
+		default:
+			br.skip(wire)
+		}
+	}
+	return blob_type, data, br.err
+}
+
+// primitiveBlock decodes one PrimitiveBlock. Every string index and every array of dense nodes is checked,
+// so a malformed block gives an error.
+func (osm *osmReader) primitiveBlock(data []byte) error {
+	var strings_table []string
+	var groups [][]byte
+	granularity, lat_offset, lon_offset := int64(100), int64(0), int64(0)
+	pr := protoReader{data: data}
+	for field, wire, ok := pr.next(); ok; field, wire, ok = pr.next() {
+		switch field {
+		case 1:
+			sr := protoReader{data: pr.bytes()}
+			for f, w, ok := sr.next(); ok; f, w, ok = sr.next() {
+				if f == 1 {
+					strings_table = append(strings_table, string(sr.bytes()))
+				} else {
+					sr.skip(w)
+				}
+			}
+			if sr.err != nil {
+				return sr.err
+			}
+		case 2:
+			groups = append(groups, pr.bytes())
+		case 17:
+			granularity = int64(pr.varint())
+		case 19:
+			lat_offset = int64(pr.varint())
+		case 20:
+			lon_offset = int64(pr.varint())
+		default:
+			pr.skip(wire)
+		}
+	}
+	if pr.err != nil {
+		return pr.err
+	}
+	position := func(lat, lon int64) [2]float64 {
+		return [2]float64{1e-9 * float64(lat_offset+granularity*lat), 1e-9 * float64(lon_offset+granularity*lon)}
+	}
+	add_node := func(id int64, p [2]float64) {
+		// longitudes west of the antimeridian are moved next to the area, as the projections do
+		p[1] = wrapLon(p[1])
+		if p[0] >= osm.region.South && p[0] <= osm.region.North && p[1] >= osm.region.West && p[1] <= osm.region.East {
+			osm.nodes[id] = p
+		}
+	}
+	lookup := func(index uint64) (string, error) {
+		if index >= uint64(len(strings_table)) {
+			return "", fmt.Errorf("osm pbf: string %d outside the table of %d", index, len(strings_table))
+		}
+		return strings_table[index], nil
+	}
+
+	for _, group := range groups {
+		gr := protoReader{data: group}
+		for field, wire, ok := gr.next(); ok; field, wire, ok = gr.next() {
+			var err error
+			switch field {
+			case 1: // Node
+				var id, lat, lon int64
+				nr := protoReader{data: gr.bytes()}
+				for f, w, ok := nr.next(); ok; f, w, ok = nr.next() {
+					switch f {
+					case 1:
+						id = zigzag(nr.varint())
+					case 8:
+						lat = zigzag(nr.varint())
+					case 9:
+						lon = zigzag(nr.varint())
+					default:
+						nr.skip(w)
+					}
+				}
+				if nr.err != nil {
+					return nr.err
+				}
+				add_node(id, position(lat, lon))
+				osm.node_count++
+			case 2: // DenseNodes
+				var ids, lats, lons []uint64
+				dr := protoReader{data: gr.bytes()}
+				for f, w, ok := dr.next(); ok && err == nil; f, w, ok = dr.next() {
+					switch f {
+					case 1:
+						ids, err = packed(dr.bytes())
+					case 8:
+						lats, err = packed(dr.bytes())
+					case 9:
+						lons, err = packed(dr.bytes())
+					default:
+						dr.skip(w)
+					}
+				}
+				if err == nil {
+					err = dr.err
+				}
+				if err != nil {
+					return err
+				}
+				if len(lats) != len(ids) || len(lons) != len(ids) {
+					return fmt.Errorf("osm pbf: dense nodes with %d ids, %d latitudes and %d longitudes", len(ids), len(lats), len(lons))
+				}
+				var id, lat, lon int64
+				for k := range ids {
+					id += zigzag(ids[k])
+					lat += zigzag(lats[k])
+					lon += zigzag(lons[k])
+					add_node(id, position(lat, lon))
+				}
+				osm.node_count += len(ids)
+			case 3: // Way
+				var keys, vals, refs []uint64
+				wr := protoReader{data: gr.bytes()}
+				for f, w, ok := wr.next(); ok && err == nil; f, w, ok = wr.next() {
+					switch f {
+					case 2:
+						keys, err = packed(wr.bytes())
+					case 3:
+						vals, err = packed(wr.bytes())
+					case 8:
+						refs, err = packed(wr.bytes())
+					default:
+						wr.skip(w)
+					}
+				}
+				if err == nil {
+					err = wr.err
+				}
+				if err != nil {
+					return err
+				}
+				if len(vals) != len(keys) {
+					return fmt.Errorf("osm pbf: way with %d keys and %d values", len(keys), len(vals))
+				}
+				osm.way_count++
+				tags := make(map[string]string)
+				for k := range keys {
+					key, err := lookup(keys[k])
+					if err != nil {
+						return err
+					}
+					val, err := lookup(vals[k])
+					if err != nil {
+						return err
+					}
+					tags[key] = val
+				}
+				if !osm.keep(tags) {
+					continue
+				}
+				way := osmWay{tags: tags}
+				var ref int64
+				inside := false
+				for _, d := range refs {
+					ref += zigzag(d)
+					if p, ok := osm.nodes[ref]; ok {
+						way.nodes = append(way.nodes, &p)
+						inside = true
+					} else {
+						way.nodes = append(way.nodes, nil)
+					}
+				}
+				if inside {
+					osm.ways = append(osm.ways, way)
+				}
+			default:
+				gr.skip(wire)
+			}
+		}
+		if gr.err != nil {
+			return gr.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProtoReaderVarint(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want uint64
+	}{
+		{[]byte{0}, 0},
+		{[]byte{1}, 1},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x01}, 128},
+		{[]byte{0xac, 0x02}, 300},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, math.MaxUint32},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		pr := protoReader{data: tt.data}
+		if got := pr.varint(); got != tt.want || pr.err != nil || pr.pos != len(tt.data) {
+			t.Errorf("varint(% x) = %d at %d, error %v; want %d", tt.data, got, pr.pos, pr.err, tt.want)
+		}
+	}
+}
+
+func TestProtoReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		read func(pr *protoReader)
+	}{
+		{"truncated varint", []byte{0x80, 0x80}, func(pr *protoReader) { pr.varint() }},
+		{"empty varint", nil, func(pr *protoReader) { pr.varint() }},
+		{"varint too long", bytes.Repeat([]byte{0xff}, 11), func(pr *protoReader) { pr.varint() }},
+		{"truncated bytes", []byte{5, 'a', 'b'}, func(pr *protoReader) { pr.bytes() }},
+		{"huge length", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, func(pr *protoReader) { pr.bytes() }},
+		{"truncated fixed64", []byte{1, 2, 3}, func(pr *protoReader) { pr.skip(1) }},
+		{"truncated fixed32", []byte{1, 2}, func(pr *protoReader) { pr.skip(5) }},
+		{"group wire type", []byte{0}, func(pr *protoReader) { pr.skip(3) }},
+	}
+	for _, tt := range tests {
+		pr := protoReader{data: tt.data}
+		tt.read(&pr)
+		if pr.err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		// the message ends after an error
+		if _, _, ok := pr.next(); ok {
+			t.Errorf("%s: next field after an error", tt.name)
+		}
+	}
+}
+
+func TestProtoReaderFields(t *testing.T) {
+	// field 1 varint 150, field 2 bytes "hi", field 3 fixed64, field 4 fixed32, field 5 varint 1
+	data := []byte{0x08, 0x96, 0x01, 0x12, 2, 'h', 'i', 0x19, 1, 2, 3, 4, 5, 6, 7, 8, 0x25, 1, 2, 3, 4, 0x28, 1}
+	pr := protoReader{data: data}
+	var fields []int
+	for field, wire, ok := pr.next(); ok; field, wire, ok = pr.next() {
+		fields = append(fields, field)
+		switch field {
+		case 1:
+			if v := pr.varint(); v != 150 {
+				t.Errorf("field 1 = %d, want 150", v)
+			}
+		case 2:
+			if b := string(pr.bytes()); b != "hi" {
+				t.Errorf("field 2 = %q, want hi", b)
+			}
+		case 5:
+			if v := pr.varint(); v != 1 {
+				t.Errorf("field 5 = %d, want 1", v)
+			}
+		default:
+			pr.skip(wire)
+		}
+	}
+	if pr.err != nil || !reflect.DeepEqual(fields, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("fields %v, error %v", fields, pr.err)
+	}
+}
+
+func TestPacked(t *testing.T) {
+	got, err := packed([]byte{0x03, 0x8e, 0x02, 0x9e, 0xa7, 0x05})
+	if want := []uint64{3, 270, 86942}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("packed = %v, %v; want %v", got, err, want)
+	}
+	if got, err := packed(nil); err != nil || len(got) != 0 {
+		t.Errorf("packed(nil) = %v, %v", got, err)
+	}
+	if _, err := packed([]byte{0x03, 0x8e}); err == nil {
+		t.Errorf("packed with a truncated varint gives no error")
+	}
+}
+
+func TestZigzag(t *testing.T) {
+	for _, tt := range []struct {
+		v    uint64
+		want int64
+	}{{0, 0}, {1, -1}, {2, 1}, {3, -2}, {4294967294, 2147483647}, {4294967295, -2147483648}, {math.MaxUint64, math.MinInt64}} {
+		if got := zigzag(tt.v); got != tt.want {
+			t.Errorf("zigzag(%d) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+// pbVarint, pbBytes and pbPacked encode protocol buffer fields for building test extracts.
+func pbVarint(field int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(field<<3))
+	return binary.AppendUvarint(b, v)
+}
+
+func pbBytes(field int, data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbPacked(field int, values ...int64) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.AppendUvarint(data, uint64(v<<1^(v>>63)))
+	}
+	return pbBytes(field, data)
+}
+
+func pbUnsigned(field int, values ...uint64) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.AppendUvarint(data, v)
+	}
+	return pbBytes(field, data)
+}
+
+// osmExtract writes an extract of one raw OSMData block holding the primitive block.
+func osmExtract(t *testing.T, block []byte) string {
+	t.Helper()
+	blob := pbBytes(1, block)
+	header := append(pbBytes(1, []byte("OSMData")), pbVarint(3, uint64(len(blob)))...)
+	var file bytes.Buffer
+	binary.Write(&file, binary.BigEndian, uint32(len(header)))
+	file.Write(header)
+	file.Write(blob)
+	filename := filepath.Join(t.TempDir(), "test.osm.pbf")
+	if err := ioutil.WriteFile(filename, file.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// osmBlock is a primitive block with the strings "", "railway", "rail", "name", "Line", three dense nodes
+// and a way, given its group content.
+func osmBlock(dense, way []byte) []byte {
+	var strings_table []byte
+	for _, s := range []string{"", "railway", "rail", "name", "Line"} {
+		strings_table = append(strings_table, pbBytes(1, []byte(s))...)
+	}
+	group := append(pbBytes(2, dense), pbBytes(3, way)...)
+	return append(pbBytes(1, strings_table), pbBytes(2, group)...)
+}
+
+func TestReadOSMPBF(t *testing.T) {
+	defer func(a mapRectangle) { area = a }(area)
+	area = mapRectangle{North: 36, East: 136, South: 34, West: 135}
+	// nodes 1, 2 and 3 delta coded, at 35.0/135.5, 35.1/135.6 and 37.0/135.7 in units of 100 nanodegrees
+	dense := append(append(pbPacked(1, 1, 1, 1), pbPacked(8, 350000000, 1000000, 19000000)...), pbPacked(9, 1355000000, 1000000, 1000000)...)
+	way := append(append(append(pbVarint(1, 7), pbUnsigned(2, 1, 3)...), pbUnsigned(3, 2, 4)...), pbPacked(8, 1, 1, 1)...)
+	keep := func(tags map[string]string) bool { return tags["railway"] == "rail" }
+
+	ways, err := readOSMPBF(osmExtract(t, osmBlock(dense, way)), area, keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ways) != 1 {
+		t.Fatalf("%d ways, want 1", len(ways))
+	}
+	w := ways[0]
+	if !reflect.DeepEqual(w.tags, map[string]string{"railway": "rail", "name": "Line"}) {
+		t.Errorf("tags %v", w.tags)
+	}
+	// the third node is north of the region
+	if len(w.nodes) != 3 || w.nodes[0] == nil || w.nodes[1] == nil || w.nodes[2] != nil {
+		t.Fatalf("nodes %v, want two positions and a node outside", w.nodes)
+	}
+	if p := *w.nodes[1]; math.Abs(p[0]-35.1) > 1e-9 || math.Abs(p[1]-135.6) > 1e-9 {
+		t.Errorf("second node at %v, want 35.1, 135.6", p)
+	}
+}
+
+func TestReadOSMPBFMalformed(t *testing.T) {
+	dense := append(append(pbPacked(1, 1, 1), pbPacked(8, 350000000, 1)...), pbPacked(9, 1355000000, 1)...)
+	way := append(append(pbUnsigned(2, 1), pbUnsigned(3, 2)...), pbPacked(8, 1, 1)...)
+	tests := []struct {
+		name  string
+		block []byte
+		want  string
+	}{
+		{"key outside the strings", osmBlock(dense, append(append(pbUnsigned(2, 9), pbUnsigned(3, 2)...), pbPacked(8, 1)...)), "string 9 outside"},
+		{"value outside the strings", osmBlock(dense, append(append(pbUnsigned(2, 1), pbUnsigned(3, 5)...), pbPacked(8, 1)...)), "string 5 outside"},
+		{"keys without values", osmBlock(dense, append(pbUnsigned(2, 1, 3), pbUnsigned(3, 2)...)), "2 keys and 1 values"},
+		{"dense without longitudes", osmBlock(append(pbPacked(1, 1, 1), pbPacked(8, 1, 1)...), way), "2 ids, 2 latitudes and 0 longitudes"},
+		{"short dense latitudes", osmBlock(append(append(pbPacked(1, 1, 1), pbPacked(8, 1)...), pbPacked(9, 1, 1)...), way), "2 ids, 1 latitudes"},
+		{"truncated block", osmBlock(dense, way)[:20], "truncated"},
+	}
+	region := mapRectangle{North: 90, East: 180, South: -90, West: -180}
+	for _, tt := range tests {
+		_, err := readOSMPBF(osmExtract(t, tt.block), region, func(map[string]string) bool { return true })
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReadOSMPBFTruncatedFile(t *testing.T) {
+	dense := append(append(pbPacked(1, 1), pbPacked(8, 1)...), pbPacked(9, 1)...)
+	data, err := ioutil.ReadFile(osmExtract(t, osmBlock(dense, pbPacked(8, 1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "cut.osm.pbf")
+	for _, n := range []int{2, 6, len(data) - 1} {
+		if err := ioutil.WriteFile(filename, data[:n], 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readOSMPBF(filename, area, func(map[string]string) bool { return true }); err == nil {
+			t.Errorf("file cut at %d of %d bytes gives no error", n, len(data))
+		}
+	}
+	os.Remove(filename)
+}
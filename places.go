@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"os"
+)
+
+// marker_radius is the radius in pixels of the ring drawn around each place on the overlay
+const marker_radius = 3
+
+var marker_color = color.RGBA{255, 0, 0, 255}
+var marker_outside_area_color = color.RGBA{255, 160, 0, 255}
+
+// drawPlaces draws the places on top of a colour copy of the heightmap, a ring around the tile of each place
+// with the tile itself filled. Places in the margin outside the area are drawn in orange.
+func drawPlaces(heightmap image.Image, points []mapPoint, proj projection) *image.RGBA {
+	b := heightmap.Bounds()
+	overlay := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(overlay, overlay.Bounds(), heightmap, b.Min, draw.Src)
+	for _, p := range points {
+		where := p.outside(proj)
+		if where == "map" {
+			continue
+		}
+		cl := marker_color
+		if where == "area" {
+			cl = marker_outside_area_color
+		}
+		tx, ty := p.tile()
+		overlay.SetRGBA(tx, ty, cl)
+		for dy := -marker_radius; dy <= marker_radius; dy++ {
+			for dx := -marker_radius; dx <= marker_radius; dx++ {
+				d := dx*dx + dy*dy
+				if d > marker_radius*marker_radius || d < (marker_radius-1)*(marker_radius-1) {
+					continue
+				}
+				overlay.SetRGBA(tx+dx, ty+dy, cl)
+			}
+		}
+	}
+	return overlay
+}
+
+// reportSharedTiles prints the places that fall on the same tile as an earlier one.
+func reportSharedTiles(points []mapPoint) {
+	first := make(map[[2]int]string)
+	for _, p := range points {
+		tx, ty := p.tile()
+		if name, ok := first[[2]int{tx, ty}]; ok {
+			fmt.Fprintf(os.Stderr, "%q shares tile %d,%d with %q\n", p.name, tx, ty, name)
+			continue
+		}
+		first[[2]int{tx, ty}] = p.name
+	}
+}
+
+// placesCommand is the "places" subcommand, which lists the Simutrans tiles of stations and towns read from
+// a GTFS stops.txt or a CSV of named points, and marks them on a copy of the heightmap.
+func placesCommand(args []string) {
+	flags := flag.NewFlagSet("places", flag.ExitOnError)
+	meta := flags.String("m", "", "sidecar .meta.json written with the map")
+	config := flags.String("f", "", "config file of the map, when there is no sidecar")
+	input := flags.String("i", "", "GTFS stops.txt or CSV with name, lat and lon columns")
+	output := flags.String("o", "", "CSV of the tiles to write, stdout when empty")
+	overlay := flags.String("overlay", "", "PNG with the places marked on the heightmap")
+	heightmap := flags.String("map", "", "heightmap under the overlay, the image of the sidecar or config when empty")
+	flags.Parse(args)
+
+	var proj projection
+	var image_file string
+	switch {
+	case *meta != "":
+		proj, image_file = projectionFromMetadata(*meta)
+	case *config != "":
+		proj, image_file, _ = projectionFromConfig(*config)
+	}
+	if proj == nil || *input == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *heightmap != "" {
+		image_file = *heightmap
+	}
+
+	points := readPointsCSV(*input, proj)
+	reportSharedTiles(points)
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writePointsCSV(w, points, proj); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *overlay == "" {
+		return
+	}
+	f, err := os.Open(image_file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		log.Fatalf("%s: %v, the overlay needs the PNG heightmap\n", image_file, err)
+	}
+	width, height := proj.size()
+	if img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+		log.Fatalf("%s is %dx%d but the map is %dx%d\n", image_file, img.Bounds().Dx(), img.Bounds().Dy(), width, height)
+	}
+	saveImage(drawPlaces(img, points, proj), *overlay)
+}
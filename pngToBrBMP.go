@@ -1 +1,141 @@
-package simumap
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BMP headers, BITMAPFILEHEADER then BITMAPINFOHEADER, and a palette of 256 BGRX entries
+const bmp_file_header_size = 14
+const bmp_info_header_size = 40
+const bmp_palette_size = 256 * 4
+
+// writeBMP encodes img as an 8-bit palettized BMP with a grey palette, which is what older Simutrans
+// builds read as a heightmap. Rows are stored bottom-up and padded to 4 bytes.
+func writeBMP(w io.Writer, img *image.Gray) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	stride := (width + 3) &^ 3
+	offset := bmp_file_header_size + bmp_info_header_size + bmp_palette_size
+	header := []interface{}{
+		[2]byte{'B', 'M'},
+		uint32(offset + stride*height), // file size
+		uint32(0),                      // reserved
+		uint32(offset),                 // offset of the pixels
+		uint32(bmp_info_header_size),
+		int32(width),
+		int32(height), // positive height means bottom-up
+		uint16(1),     // planes
+		uint16(8),     // bits per pixel
+		uint32(0),     // BI_RGB, no compression
+		uint32(stride * height),
+		int32(2835), // 72 dpi in pixels per metre
+		int32(2835),
+		uint32(256), // colours in the palette
+		uint32(0),   // all of them important
+	}
+	bw := bufio.NewWriter(w)
+	for _, v := range header {
+		if err := binary.Write(bw, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 256; i++ {
+		bw.Write([]byte{uint8(i), uint8(i), uint8(i), 0})
+	}
+	row := make([]byte, stride)
+	for y := height - 1; y >= 0; y-- {
+		start := y * img.Stride
+		copy(row, img.Pix[start:start+width])
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func saveBMP(img *image.Gray, filename string) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	if err = writeBMP(f, img); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// toGray returns the brightness of every pixel of a simumap image. Grey images are copied as they are;
+// in the debug colour mode the brightness is in the green channel for land and the blue one for water,
+// so the brightest channel is taken. RGBA and NRGBA images are read from their channels, ignoring alpha,
+// so that transparent water rendered in memory keeps its value. A PNG file does not keep it: PNG stores
+// colour without premultiplied alpha and fully transparent pixels are written as zero, so water read back
+// from a debug PNG with transparent water is black.
+func toGray(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok {
+		return gray
+	}
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var rgb []uint8
+			switch c := img.(type) {
+			case *image.RGBA:
+				i := c.PixOffset(x, y)
+				rgb = c.Pix[i : i+3]
+			case *image.NRGBA:
+				i := c.PixOffset(x, y)
+				rgb = c.Pix[i : i+3]
+			default:
+				n := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				rgb = []uint8{n.R, n.G, n.B}
+			}
+			num := rgb[0]
+			if rgb[1] > num {
+				num = rgb[1]
+			}
+			if rgb[2] > num {
+				num = rgb[2]
+			}
+			gray.SetGray(x-b.Min.X, y-b.Min.Y, color.Gray{num})
+		}
+	}
+	return gray
+}
+
+// bmpCommand is the "bmp" subcommand, which converts a PNG written by simumap into a Simutrans-ready BMP.
+func bmpCommand(args []string) {
+	flags := flag.NewFlagSet("bmp", flag.ExitOnError)
+	input := flags.String("i", "", "PNG written by simumap")
+	output := flags.String("o", "", "BMP to write, the input with .bmp when empty")
+	flags.Parse(args)
+	if *input == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(*input, filepath.Ext(*input)) + ".bmp"
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	saveBMP(toGray(img), *output)
+	fmt.Printf("%s: %dx%d\n", *output, img.Bounds().Dx(), img.Bounds().Dy())
+}
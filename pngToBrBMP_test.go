@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestWriteBMP(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(img.Pix, []uint8{1, 2, 3, 4, 5, 6})
+	var buf bytes.Buffer
+	if err := writeBMP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	offset := 14 + 40 + 256*4
+	// rows of 3 pixels are padded to 4 bytes
+	if len(b) != offset+2*4 {
+		t.Fatalf("file of %d bytes, want %d", len(b), offset+8)
+	}
+	le32 := func(at int) uint32 { return binary.LittleEndian.Uint32(b[at:]) }
+	le16 := func(at int) uint16 { return binary.LittleEndian.Uint16(b[at:]) }
+	fields := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"file size", le32(2), uint32(len(b))},
+		{"pixel offset", le32(10), uint32(offset)},
+		{"info header size", le32(14), 40},
+		{"width", le32(18), 3},
+		{"height", le32(22), 2},
+		{"planes", uint32(le16(26)), 1},
+		{"bits per pixel", uint32(le16(28)), 8},
+		{"compression", le32(30), 0},
+		{"image size", le32(34), 8},
+		{"palette colours", le32(46), 256},
+	}
+	if string(b[:2]) != "BM" {
+		t.Errorf("signature %q, want BM", b[:2])
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	for i := 0; i < 256; i++ {
+		if entry := b[54+4*i : 58+4*i]; !bytes.Equal(entry, []byte{uint8(i), uint8(i), uint8(i), 0}) {
+			t.Fatalf("palette entry %d = %v, want grey %d", i, entry, i)
+		}
+	}
+	// bottom-up: the last row of the image comes first
+	if pixels := b[offset:]; !bytes.Equal(pixels, []byte{4, 5, 6, 0, 1, 2, 3, 0}) {
+		t.Errorf("pixels %v, want the rows bottom-up with padding", pixels)
+	}
+}
+
+func TestToGray(t *testing.T) {
+	tests := []struct {
+		name string
+		c    color.RGBA
+		want uint8
+	}{
+		{"land", color.RGBA{0, 140, 0, 255}, 140},
+		{"water", color.RGBA{0, 0, 90, 255}, 90},
+		// transparent water as painted by elevationToColor keeps its value in memory
+		{"transparent water", color.RGBA{0, 0, 90, 0}, 90},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.SetRGBA(0, 0, tt.c)
+		if got := toGray(img).GrayAt(0, 0).Y; got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	if toGray(gray) != gray {
+		t.Errorf("a grey image is not returned as it is")
+	}
+}
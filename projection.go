@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+)
+
+// projection maps output pixels to the ground. Pixel (x, y) is centred on the point returned by pixelToLatLon.
+type projection interface {
+	size() (int, int)
+	pixelToLatLon(x, y float64) (float64, float64)
+	latLonToPixel(lat, lon float64) (float64, float64)
+	footprint(x, y int) mapRectangle
+}
+
+// map_projection is the projection of the map being rendered
+var map_projection projection
+
+// wrapLon moves lon by whole turns to within 180 degrees of the middle of the area, so that points west of
+// the antimeridian land on maps whose East was moved past 180 by normalizeArea.
+func wrapLon(lon float64) float64 {
+	center := (area.West + area.East) / 2
+	return lon - 360*math.Floor((lon-center+180)/360)
+}
+
+// pixelSize returns the ground size in metres of pixel (x, y) of proj, as the side of a square of the same area.
+func pixelSize(proj projection, x, y float64) float64 {
+	lat, _ := proj.pixelToLatLon(x, y)
+	_, west := proj.pixelToLatLon(x-0.5, y)
+	_, east := proj.pixelToLatLon(x+0.5, y)
+	north, _ := proj.pixelToLatLon(x, y-0.5)
+	south, _ := proj.pixelToLatLon(x, y+0.5)
+	ew := parallelRadius(lat) * (east - west) * math.Pi / 180
+	ns := meridianRadius(lat) * (north - south) * math.Pi / 180
+	return math.Sqrt(ew * ns)
+}
+
+// equirectangularProjection is the Degree style: scale_x pixels per degree of longitude, scale_y per degree of latitude.
+type equirectangularProjection struct {
+	scale_x float64
+	scale_y float64
+	width   int
+	height  int
+}
+
+func (ep equirectangularProjection) size() (int, int) {
+	return ep.width, ep.height
+}
+
+func (ep equirectangularProjection) pixelToLatLon(x, y float64) (float64, float64) {
+	return area.North - y/ep.scale_y, area.West + x/ep.scale_x
+}
+
+func (ep equirectangularProjection) latLonToPixel(lat, lon float64) (float64, float64) {
+	return (wrapLon(lon) - area.West) * ep.scale_x, (area.North - lat) * ep.scale_y
+}
+
+func (ep equirectangularProjection) footprint(x, y int) mapRectangle {
+	lat, lon := ep.pixelToLatLon(float64(x), float64(y))
+	return mapRectangle{North: lat + 0.5/ep.scale_y, East: lon + 0.5/ep.scale_x, South: lat - 0.5/ep.scale_y, West: lon - 0.5/ep.scale_x}
+}
+
+// mercatorProjection is the Mercator style: scale pixels per unit of the Mercator plane.
+type mercatorProjection struct {
+	scale   float64
+	v_west  float64
+	w_north float64
+	width   int
+	height  int
+}
+
+func (mp mercatorProjection) size() (int, int) {
+	return mp.width, mp.height
+}
+
+func (mp mercatorProjection) pixelToLatLon(x, y float64) (float64, float64) {
+	return wToLat(mp.w_north - y/mp.scale), vToLon(x/mp.scale + mp.v_west)
+}
+
+func (mp mercatorProjection) latLonToPixel(lat, lon float64) (float64, float64) {
+	return (lonToV(wrapLon(lon)) - mp.v_west) * mp.scale, (mp.w_north - latToW(lat)) * mp.scale
+}
+
+func (mp mercatorProjection) footprint(x, y int) mapRectangle {
+	north, west := mp.pixelToLatLon(float64(x)-0.5, float64(y)-0.5)
+	south, east := mp.pixelToLatLon(float64(x)+0.5, float64(y)+0.5)
+	return mapRectangle{North: north, East: east, South: south, West: west}
+}
+
+// projectionDomain returns the range of latitude and longitude covered by the pixel centres of the projection.
+func projectionDomain(proj projection) mapRectangle {
+	width, height := proj.size()
+	domain := mapRectangle{North: math.Inf(-1), East: math.Inf(-1), South: math.Inf(1), West: math.Inf(1)}
+	add := func(x, y int) {
+		lat, lon := proj.pixelToLatLon(float64(x), float64(y))
+		domain.North, domain.South = math.Max(domain.North, lat), math.Min(domain.South, lat)
+		domain.East, domain.West = math.Max(domain.East, lon), math.Min(domain.West, lon)
+	}
+	for x := 0; x < width; x++ {
+		add(x, 0)
+		add(x, height-1)
+	}
+	for y := 0; y < height; y++ {
+		add(0, y)
+		add(width-1, y)
+	}
+	return domain
+}
+
+// geoTransform returns the affine transform from pixel corners to the reference system of the projection,
+// in the order of GDAL: x of the west edge, x per pixel, 0, y of the north edge, 0, y per pixel (negative).
+// epsg is the code of the reference system. ok is false for projections that are not affine, like Compressed.
+func geoTransform(proj projection) (transform [6]float64, epsg int, ok bool) {
+	switch p := proj.(type) {
+	case equirectangularProjection:
+		transform = [6]float64{area.West - 0.5/p.scale_x, 1 / p.scale_x, 0, area.North + 0.5/p.scale_y, 0, -1 / p.scale_y}
+		return transform, 4326, true
+	case mercatorProjection:
+		// the Mercator plane in metres is EPSG:3857 on the sphere and World Mercator on the ellipsoid
+		epsg = 3857
+		if use_ellipsoid {
+			epsg = 3395
+		}
+		step := EARTH_RADIUS / p.scale
+		transform = [6]float64{EARTH_RADIUS*p.v_west - 0.5*step, step, 0, EARTH_RADIUS*p.w_north + 0.5*step, 0, -step}
+		return transform, epsg, true
+	}
+	return transform, 0, false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+)
+
+// degree_epsilon absorbs the rounding of the projections at the edges of the area
+const degree_epsilon = 1e-9
+
+// heightMap is the elevation of every output pixel before it is turned into colours.
+type heightMap struct {
+	width     int
+	height    int
+	elevation []float32 // metres, NaN where there is no data
+	coverage  []float32 // share of the pixel that is water in SWBD
+	water     []bool
+}
+
+func newHeightMap(width, height int) *heightMap {
+	var hm heightMap
+	hm.width = width
+	hm.height = height
+	hm.elevation = make([]float32, width*height)
+	hm.coverage = make([]float32, width*height)
+	hm.water = make([]bool, width*height)
+	return &hm
+}
+
+// level returns the elevation of pixel i in the int16 convention of elevationToColor.
+func (hm *heightMap) level(i int) int16 {
+	if hm.water[i] {
+		return water_level
+	}
+	if math.IsNaN(float64(hm.elevation[i])) {
+		return math.MinInt16
+	}
+	return clampElevation(float64(hm.elevation[i]))
+}
+
+// clampElevation rounds to int16, keeping overshoot of the cubic kernels away from the no data value.
+func clampElevation(elevation float64) int16 {
+	elevation = math.Floor(elevation + 0.5)
+	if elevation < math.MinInt16+1 {
+		return math.MinInt16 + 1
+	} else if elevation > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	return int16(elevation)
+}
+
+// renderMap samples every pixel of proj exactly once, row by row from the north.
+// Only the cells around the current row are kept in memory. In dryrun mode it only lists the cells and returns nil.
+func renderMap(proj projection, dryrun bool) *heightMap {
+	map_projection = proj
+	width, height := proj.size()
+	domain := projectionDomain(proj)
+	if margin_style == Water {
+		domain.North = math.Min(domain.North, area.North)
+		domain.East = math.Min(domain.East, area.East)
+		domain.South = math.Max(domain.South, area.South)
+		domain.West = math.Max(domain.West, area.West)
+	}
+
+	dem := newDemSampler(dryrun)
+	if dryrun {
+		for lat := int16(math.Floor(domain.South + degree_epsilon)); float64(lat) < domain.North-degree_epsilon; lat++ {
+			for lon := int16(math.Floor(domain.West + degree_epsilon)); float64(lon) < domain.East-degree_epsilon; lon++ {
+				dem.cell(lat, lon)
+			}
+		}
+		return nil
+	}
+
+	hm := newHeightMap(width, height)
+	var elevation, coverage float64
+	for y := 0; y < height; y++ {
+		row_north := math.Inf(-1)
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			lat, lon := proj.pixelToLatLon(float64(x), float64(y))
+			if margin_style == Water && (lat < area.South-degree_epsilon || lat > area.North+degree_epsilon ||
+				lon < area.West-degree_epsilon || lon > area.East+degree_epsilon) {
+				hm.elevation[i], hm.coverage[i], hm.water[i] = float32(water_level), 1, true
+				continue
+			}
+			footprint := proj.footprint(x, y)
+			row_north = math.Max(row_north, footprint.North)
+			elevation, coverage = dem.pixelElevation(lat, lon, footprint)
+			hm.elevation[i] = float32(elevation)
+			hm.coverage[i] = float32(coverage)
+			hm.water[i] = coverage > 0 && coverage >= water_coverage
+		}
+		// the rows below never read north of this row, apart from the reach of the kernel
+		if !math.IsInf(row_north, -1) {
+			dem.release(row_north + float64(kernelRadius()+1)/float64(CELL_DIV))
+		}
+	}
+	return hm
+}
+
+// shoreRamp lowers the land within ramp pixels of the shoreline towards the water, so that the coast becomes
+// a slope instead of a cliff. The distance to the shoreline is estimated with sub-pixel accuracy from the water
+// coverage: a pixel with coverage c has the shoreline at 0.5-c pixels from its centre.
+func (hm *heightMap) shoreRamp(ramp float64) {
+	distance := make([]float64, len(hm.coverage))
+	for i, c := range hm.coverage {
+		if c > 0 {
+			distance[i] = 0.5 - float64(c)
+		} else {
+			distance[i] = math.Inf(1)
+		}
+	}
+	// two pass chamfer distance transform over the 8 neighbours
+	relax := func(i, x, y int, dx, dy int, step float64) {
+		x += dx
+		y += dy
+		if x < 0 || y < 0 || x >= hm.width || y >= hm.height {
+			return
+		}
+		distance[i] = math.Min(distance[i], distance[y*hm.width+x]+step)
+	}
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			relax(i, x, y, -1, 0, 1)
+			relax(i, x, y, 0, -1, 1)
+			relax(i, x, y, -1, -1, math.Sqrt2)
+			relax(i, x, y, 1, -1, math.Sqrt2)
+		}
+	}
+	for y := hm.height - 1; y >= 0; y-- {
+		for x := hm.width - 1; x >= 0; x-- {
+			i := y*hm.width + x
+			relax(i, x, y, 1, 0, 1)
+			relax(i, x, y, 0, 1, 1)
+			relax(i, x, y, 1, 1, math.Sqrt2)
+			relax(i, x, y, -1, 1, math.Sqrt2)
+		}
+	}
+
+	// the foot of the ramp is the lowest land elevation
+	shore := float64(water_level) + 1
+	for i, d := range distance {
+		if hm.water[i] || d >= ramp || math.IsNaN(float64(hm.elevation[i])) || float64(hm.elevation[i]) <= shore {
+			continue
+		}
+		t := math.Max(d, 0) / ramp
+		t = t * t * (3 - 2*t)
+		hm.elevation[i] = float32(shore + (float64(hm.elevation[i])-shore)*t)
+	}
+}
+
+// paintMap turns the elevation into the colours of the output image.
+func paintMap(hm *heightMap) {
+	level_anchors = levelAnchors(elevation_level)
+	lm = newLargeMap(area, hm.width, hm.height)
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			cl := elevationToColor(hm.level(y*hm.width + x))
+			lm.data.Set(x, y, cl)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// route is a railway or road line on the map, as waypoints joined by straight legs in one of the 8 directions.
+// steep[i] is set when the leg from waypoint i to i+1 is too steep on the terrain.
+type route struct {
+	name      string
+	kind      string
+	waypoints [][2]int
+	steep     []bool
+}
+
+// routeKind tells whether the tags of a line describe a railway or a road, "" for neither.
+func routeKind(tags map[string]string) string {
+	switch tags["railway"] {
+	case "rail", "light_rail", "narrow_gauge", "subway", "monorail", "tram":
+		return "rail"
+	}
+	switch tags["highway"] {
+	case "motorway", "trunk", "primary", "secondary", "tertiary", "unclassified", "residential",
+		"motorway_link", "trunk_link", "primary_link", "secondary_link", "tertiary_link":
+		return "road"
+	}
+	return ""
+}
+
+// readLinesGeoJSON reads the LineString and MultiLineString features of a GeoJSON file as lines of
+// latitude/longitude, with the kind taken from their railway or highway property.
+func readLinesGeoJSON(filename string) (lines [][][2]float64, names, kinds []string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		log.Fatalln(err)
+	}
+	for _, f := range fc.Features {
+		var parts [][][]float64
+		switch f.Geometry.Type {
+		case "LineString":
+			var part [][]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &part)
+			parts = [][][]float64{part}
+		case "MultiLineString":
+			err = json.Unmarshal(f.Geometry.Coordinates, &parts)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Fatalf("%s: %v\n", filename, err)
+		}
+		tags := make(map[string]string)
+		for k, v := range f.Properties {
+			if s, ok := v.(string); ok {
+				tags[k] = s
+			}
+		}
+		for _, part := range parts {
+			var line [][2]float64
+			for _, c := range part {
+				if len(c) >= 2 {
+					line = append(line, [2]float64{c[1], c[0]})
+				}
+			}
+			lines = append(lines, line)
+			names = append(names, tags["name"])
+			kinds = append(kinds, routeKind(tags))
+		}
+	}
+	return
+}
+
+// simplifyLine is Douglas-Peucker: it keeps the points of the polyline that are further than tolerance
+// from the chord of the points kept around them.
+func simplifyLine(points [][2]float64, tolerance float64) [][2]float64 {
+	if len(points) < 3 {
+		return points
+	}
+	a, b := points[0], points[len(points)-1]
+	far, distance := 0, 0.0
+	for i := 1; i < len(points)-1; i++ {
+		p := points[i]
+		var d float64
+		if length := math.Hypot(b[0]-a[0], b[1]-a[1]); length == 0 {
+			d = math.Hypot(p[0]-a[0], p[1]-a[1])
+		} else {
+			d = math.Abs((b[0]-a[0])*(a[1]-p[1])-(a[0]-p[0])*(b[1]-a[1])) / length
+		}
+		if d > distance {
+			far, distance = i, d
+		}
+	}
+	if distance <= tolerance {
+		return [][2]float64{a, b}
+	}
+	left := simplifyLine(points[:far+1], tolerance)
+	return append(left[:len(left)-1], simplifyLine(points[far:], tolerance)...)
+}
+
+func intSign(a int) int {
+	if a > 0 {
+		return 1
+	} else if a < 0 {
+		return -1
+	}
+	return 0
+}
+
+func intAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// octilinear turns a path of tiles into waypoints joined by legs in the 8 directions. Between two tiles the
+// straight part is split around the diagonal part, which stays closer to the real line than an L shape.
+func octilinear(tiles [][2]int) [][2]int {
+	if len(tiles) == 0 {
+		return nil
+	}
+	path := [][2]int{tiles[0]}
+	add := func(p [2]int) {
+		last := path[len(path)-1]
+		if p == last {
+			return
+		}
+		// a leg in the direction of the last one extends it
+		if len(path) >= 2 {
+			before := path[len(path)-2]
+			if intSign(last[0]-before[0]) == intSign(p[0]-last[0]) && intSign(last[1]-before[1]) == intSign(p[1]-last[1]) {
+				path[len(path)-1] = p
+				return
+			}
+		}
+		path = append(path, p)
+	}
+	for _, b := range tiles[1:] {
+		a := path[len(path)-1]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		diagonal := intMin(intAbs(dx), intAbs(dy))
+		sx, sy := intSign(dx), intSign(dy)
+		// the straight remainder runs along the longer axis
+		rx, ry := sx*(intAbs(dx)-diagonal), sy*(intAbs(dy)-diagonal)
+		first := [2]int{a[0] + rx/2, a[1] + ry/2}
+		add(first)
+		add([2]int{first[0] + sx*diagonal, first[1] + sy*diagonal})
+		add(b)
+	}
+	return path
+}
+
+// legTiles returns the tiles of a straight leg from a to b, both included.
+func legTiles(a, b [2]int) [][2]int {
+	n := intMax(intAbs(b[0]-a[0]), intAbs(b[1]-a[1]))
+	sx, sy := intSign(b[0]-a[0]), intSign(b[1]-a[1])
+	tiles := make([][2]int, 0, n+1)
+	for k := 0; k <= n; k++ {
+		tiles = append(tiles, [2]int{a[0] + k*sx, a[1] + k*sy})
+	}
+	return tiles
+}
+
+// terrainLevels returns the height level of every tile of the heightmap: the rank of its grey value among
+// the brightness of the level table, water being level 0.
+func terrainLevels(image_file string, table []level) (func(x, y int) int, bool) {
+	f, err := os.Open(image_file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", image_file, err)
+		return nil, false
+	}
+	gray := toGray(img)
+	var brights []int
+	seen := make(map[uint8]bool)
+	for _, l := range table {
+		if !seen[l.Bright] {
+			seen[l.Bright] = true
+			brights = append(brights, int(l.Bright))
+		}
+	}
+	sort.Ints(brights)
+	if len(brights) == 0 {
+		return nil, false
+	}
+	return func(x, y int) int {
+		g := int(gray.GrayAt(x, y).Y)
+		// the highest level not brighter than the pixel; ramps fall between two levels
+		return intMax(0, sort.Search(len(brights), func(i int) bool { return brights[i] > g })-1)
+	}, true
+}
+
+// checkGradient marks the legs that climb more than one level between neighbouring tiles, which Simutrans
+// can not build, or more than grade levels per tile over the whole leg.
+func (r *route) checkGradient(levelAt func(x, y int) int, grade float64) int {
+	r.steep = make([]bool, len(r.waypoints))
+	steep := 0
+	for i := 1; i < len(r.waypoints); i++ {
+		tiles := legTiles(r.waypoints[i-1], r.waypoints[i])
+		climb, max_step := 0, 0
+		for k := 1; k < len(tiles); k++ {
+			step := intAbs(levelAt(tiles[k][0], tiles[k][1]) - levelAt(tiles[k-1][0], tiles[k-1][1]))
+			climb += step
+			max_step = intMax(max_step, step)
+		}
+		if max_step > 1 || float64(climb)/float64(len(tiles)-1) > grade {
+			r.steep[i-1] = true
+			steep++
+			fmt.Fprintf(os.Stderr, "%s %q: leg %d,%d - %d,%d climbs %d levels in %d tiles (%d at most between neighbours)\n",
+				r.kind, r.name, tiles[0][0], tiles[0][1], tiles[len(tiles)-1][0], tiles[len(tiles)-1][1], climb, len(tiles)-1, max_step)
+		}
+	}
+	return steep
+}
+
+// writeRoutesSquirrel writes the routes as a Squirrel script to include in a scenario. build_routes(pl)
+// builds every leg with the fastest way available for its kind.
+func writeRoutesSquirrel(routes []route) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Routes written by simumap %s. Include this file in a scenario and call build_routes(player).\n\n", version)
+	buf.WriteString("routes <- [\n")
+	for _, r := range routes {
+		fmt.Fprintf(&buf, "\t{ name = %s, kind = %s, waypoints = [", squirrelString(r.name), squirrelString(r.kind))
+		for i, p := range r.waypoints {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "[%d, %d]", p[0], p[1])
+		}
+		buf.WriteString("], steep = [")
+		first := true
+		for i, s := range r.steep {
+			if s {
+				if !first {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(&buf, "%d", i)
+				first = false
+			}
+		}
+		buf.WriteString("] },\n")
+	}
+	buf.WriteString("]\n\n")
+	buf.WriteString(`function best_way(wt)
+{
+	local best = null
+	foreach (w in way_desc_x.get_available_ways(wt, st_flat)) {
+		if (best == null || w.get_topspeed() > best.get_topspeed()) {
+			best = w
+		}
+	}
+	return best
+}
+
+// steep lists the legs, counted from the first waypoint, that are too steep on the generated terrain
+function build_routes(pl)
+{
+	local ways = { rail = best_way(wt_rail), road = best_way(wt_road) }
+	foreach (r in routes) {
+		for (local i = 1; i < r.waypoints.len(); i++) {
+			local from = square_x(r.waypoints[i-1][0], r.waypoints[i-1][1]).get_ground_tile()
+			local to = square_x(r.waypoints[i][0], r.waypoints[i][1]).get_ground_tile()
+			local err = command_x.build_way(pl, from, to, ways[r.kind], false)
+			if (err != null) {
+				print(r.name + " leg " + i + ": " + err)
+			}
+		}
+	}
+}
+`)
+	return buf.Bytes()
+}
+
+// writeRoutesCSV writes one line per waypoint; steep is set on the waypoint that starts a steep leg.
+func writeRoutesCSV(routes []route) []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"route", "name", "kind", "index", "x", "y", "steep"})
+	for n, r := range routes {
+		for i, p := range r.waypoints {
+			steep := ""
+			if i < len(r.steep) && r.steep[i] {
+				steep = "1"
+			}
+			cw.Write([]string{strconv.Itoa(n), r.name, r.kind, strconv.Itoa(i), strconv.Itoa(p[0]), strconv.Itoa(p[1]), steep})
+		}
+	}
+	cw.Flush()
+	return buf.Bytes()
+}
+
+// routesCommand is the "routes" subcommand, which projects railway and road lines from GeoJSON or an OSM PBF
+// extract onto the map, simplifies them to legs Simutrans can build and writes them as Squirrel or a
+// waypoint list, reporting the legs that are too steep on the generated terrain.
+func routesCommand(args []string) {
+	flags := flag.NewFlagSet("routes", flag.ExitOnError)
+	meta := flags.String("m", "", "sidecar .meta.json written with the map")
+	config := flags.String("f", "", "config file of the map, when there is no sidecar (no gradient check in the auto mode)")
+	input := flags.String("i", "", "GeoJSON with LineString features or OSM .pbf extract")
+	output := flags.String("o", "", "routes to write, Squirrel for .nut and a waypoint CSV otherwise")
+	kind := flags.String("kind", "rail", "lines to import: rail, road or all")
+	tolerance := flags.Float64("tolerance", 1, "largest distance in tiles between a line and its simplification")
+	grade := flags.Float64("grade", 0.5, "largest climb in levels per tile over a leg")
+	heightmap := flags.String("map", "", "heightmap for the gradient check, the image of the sidecar when empty")
+	flags.Parse(args)
+	switch *kind {
+	case "rail", "road", "all":
+	default:
+		log.Fatalf("-kind must be rail, road or all, got %q\n", *kind)
+	}
+
+	var proj projection
+	var image_file string
+	var table []level
+	switch {
+	case *meta != "":
+		proj, image_file = projectionFromMetadata(*meta)
+		table = readMetadata(*meta).Level
+	case *config != "":
+		proj, image_file, table = projectionFromConfig(*config)
+	}
+	if proj == nil || *input == "" || *output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *heightmap != "" {
+		image_file = *heightmap
+	}
+	wanted := func(k string) bool {
+		return k != "" && (*kind == "all" || *kind == k)
+	}
+
+	var lines [][][2]float64
+	var names, kinds []string
+	if strings.HasSuffix(strings.ToLower(*input), ".pbf") {
+		ways, err := readOSMPBF(*input, projectionDomain(proj), func(tags map[string]string) bool { return wanted(routeKind(tags)) })
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, w := range ways {
+			// nodes outside the map split a way
+			var line [][2]float64
+			for _, p := range append(w.nodes, nil) {
+				if p != nil {
+					line = append(line, *p)
+					continue
+				}
+				if len(line) >= 2 {
+					lines, names, kinds = append(lines, line), append(names, w.tags["name"]), append(kinds, routeKind(w.tags))
+				}
+				line = nil
+			}
+		}
+	} else {
+		lines, names, kinds = readLinesGeoJSON(*input)
+		untagged := 0
+		for i := range kinds {
+			if kinds[i] != "" {
+				continue
+			}
+			if *kind == "all" {
+				untagged++
+			} else {
+				// lines without tags are taken to be of the kind asked for
+				kinds[i] = *kind
+			}
+		}
+		if untagged > 0 {
+			fmt.Printf("routes: %d lines without a railway or highway tag skipped, import them with -kind rail or road\n", untagged)
+		}
+	}
+
+	width, height := proj.size()
+	var routes []route
+	for n, line := range lines {
+		if !wanted(kinds[n]) {
+			continue
+		}
+		// runs of points on the map, in pixels
+		var runs [][][2]float64
+		var run [][2]float64
+		for _, p := range append(line, [2]float64{math.NaN(), math.NaN()}) {
+			x, y := proj.latLonToPixel(p[0], p[1])
+			if !math.IsNaN(x) && x > -0.5 && y > -0.5 && x < float64(width)-0.5 && y < float64(height)-0.5 {
+				run = append(run, [2]float64{x, y})
+				continue
+			}
+			if len(run) >= 2 {
+				runs = append(runs, run)
+			}
+			run = nil
+		}
+		for _, run := range runs {
+			var tiles [][2]int
+			for _, p := range simplifyLine(run, *tolerance) {
+				tiles = append(tiles, [2]int{int(math.Floor(p[0] + 0.5)), int(math.Floor(p[1] + 0.5))})
+			}
+			if r := (route{name: names[n], kind: kinds[n], waypoints: octilinear(tiles)}); len(r.waypoints) >= 2 {
+				routes = append(routes, r)
+			}
+		}
+	}
+
+	steep := 0
+	if levelAt, ok := terrainLevels(image_file, table); ok {
+		for i := range routes {
+			steep += routes[i].checkGradient(levelAt, *grade)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "no heightmap and level table, gradients are not checked")
+	}
+
+	var data []byte
+	if strings.ToLower(filepath.Ext(*output)) == ".nut" {
+		data = writeRoutesSquirrel(routes)
+	} else {
+		data = writeRoutesCSV(routes)
+	}
+	if err := ioutil.WriteFile(*output, data, 0666); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("routes: %d routes, %d steep legs, written to %s\n", len(routes), steep, *output)
+}
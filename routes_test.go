@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimplifyLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		points    [][2]float64
+		tolerance float64
+		want      [][2]float64
+	}{
+		{"two points", [][2]float64{{0, 0}, {5, 5}}, 1, [][2]float64{{0, 0}, {5, 5}}},
+		{"straight", [][2]float64{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 0}}, 0.5, [][2]float64{{0, 0}, {3, 0}}},
+		{"corner", [][2]float64{{0, 0}, {5, 0}, {10, 0}, {10, 5}, {10, 10}}, 0.5, [][2]float64{{0, 0}, {10, 0}, {10, 10}}},
+		{"corner within tolerance", [][2]float64{{0, 0}, {5, 1}, {10, 0}}, 2, [][2]float64{{0, 0}, {10, 0}}},
+		{"zigzag", [][2]float64{{0, 0}, {1, 3}, {2, 0}, {3, 3}, {4, 0}}, 1, [][2]float64{{0, 0}, {1, 3}, {2, 0}, {3, 3}, {4, 0}}},
+		// a closed line measures from its single end point
+		{"loop", [][2]float64{{0, 0}, {4, 0}, {4, 4}, {0, 0}}, 1, [][2]float64{{0, 0}, {4, 0}, {4, 4}, {0, 0}}},
+	}
+	for _, tt := range tests {
+		if got := simplifyLine(tt.points, tt.tolerance); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOctilinear(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiles [][2]int
+		want  [][2]int
+	}{
+		{"empty", nil, nil},
+		{"single", [][2]int{{3, 3}}, [][2]int{{3, 3}}},
+		{"straight", [][2]int{{0, 0}, {5, 0}}, [][2]int{{0, 0}, {5, 0}}},
+		{"diagonal", [][2]int{{0, 0}, {4, 4}}, [][2]int{{0, 0}, {4, 4}}},
+		// the straight part is split around the diagonal
+		{"mixed", [][2]int{{0, 0}, {6, 2}}, [][2]int{{0, 0}, {2, 0}, {4, 2}, {6, 2}}},
+		{"steep", [][2]int{{0, 0}, {-1, -5}}, [][2]int{{0, 0}, {0, -2}, {-1, -3}, {-1, -5}}},
+		// legs in the same direction are merged across input points
+		{"merged", [][2]int{{0, 0}, {2, 0}, {5, 0}, {5, 3}}, [][2]int{{0, 0}, {5, 0}, {5, 3}}},
+		{"repeated", [][2]int{{1, 1}, {1, 1}, {1, 4}}, [][2]int{{1, 1}, {1, 4}}},
+	}
+	for _, tt := range tests {
+		got := octilinear(tt.tiles)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		// every leg runs along one of the 8 directions
+		for k := 1; k < len(got); k++ {
+			dx, dy := intAbs(got[k][0]-got[k-1][0]), intAbs(got[k][1]-got[k-1][1])
+			if dx != 0 && dy != 0 && dx != dy {
+				t.Errorf("%s: leg %v - %v is not octilinear", tt.name, got[k-1], got[k])
+			}
+		}
+	}
+}
+
+func TestLegTiles(t *testing.T) {
+	got := legTiles([2]int{2, 2}, [2]int{-1, 5})
+	want := [][2]int{{2, 2}, {1, 3}, {0, 4}, {-1, 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("legTiles = %v, want %v", got, want)
+	}
+}
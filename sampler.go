@@ -0,0 +1,274 @@
+package main
+
+import (
+	"math"
+)
+
+type resampling int8
+
+const (
+	Nearest resampling = iota
+	Bilinear
+	Bicubic
+	Lanczos
+)
+
+var resampling_style resampling = Bilinear
+
+// downsampling decides how an output pixel larger than the DEM spacing is computed.
+// PointSampling reads one interpolated value at the pixel, the filters average every sample in its footprint.
+// In every mode a pixel is water when at least water_coverage of its footprint is water in SWBD.
+type downsampling int8
+
+const (
+	PointSampling downsampling = iota
+	BoxFilter
+	GaussianFilter
+)
+
+var downsampling_style downsampling
+var water_coverage float64 = 0.5
+
+// demCell is one downloaded 1 degree cell. water holds the SWBD mask packed one bit per sample.
+type demCell struct {
+	received bool
+	data     []int16
+	water    []uint64
+}
+
+// demSampler reads SRTM and SWBD as one seamless grid over all cells, loading cells on first use.
+// Samples are addressed by global indices counted east from 0 deg longitude and south from 0 deg latitude,
+// so the neighbourhood of a kernel can cross cell boundaries.
+type demSampler struct {
+	dryrun   bool
+	cells    map[[2]int16]*demCell
+	last_key [2]int16
+	last     *demCell
+}
+
+func newDemSampler(dryrun bool) *demSampler {
+	return &demSampler{dryrun: dryrun, cells: make(map[[2]int16]*demCell)}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// cell returns the cell whose south west corner is (lat, lon), downloading it if needed.
+func (ds *demSampler) cell(lat, lon int16) *demCell {
+	key := [2]int16{lat, lon}
+	if ds.last != nil && ds.last_key == key {
+		return ds.last
+	}
+	if c, ok := ds.cells[key]; ok {
+		ds.last_key, ds.last = key, c
+		return c
+	}
+	elevationData, swbdData := Download(lat, lon, ds.dryrun)
+	c := &demCell{received: elevationData.received}
+	if c.received {
+		c.data = elevationData.data
+		c.water = make([]uint64, (CELL_SWBD_SIZE*CELL_SWBD_SIZE+63)/64)
+		for i, b := range swbdData {
+			if b == 0xff {
+				c.water[i/64] |= 1 << uint(i%64)
+			}
+		}
+	}
+	ds.cells[key] = c
+	ds.last_key, ds.last = key, c
+	return c
+}
+
+// release forgets every cell lying entirely north of lat, so that a map rendered from north to south
+// only keeps a window of cells in memory.
+func (ds *demSampler) release(lat float64) {
+	for key := range ds.cells {
+		if float64(key[0]) > lat {
+			delete(ds.cells, key)
+		}
+	}
+	ds.last = nil
+}
+
+// sample returns the SRTM sample at a global index. x counts CELL_DIV samples per degree east,
+// y counts CELL_DIV samples per degree south. A cell owns its rows and columns 0 to CELL_DIV-1;
+// the last row and column of each file repeat those of the neighbour and are not used.
+func (ds *demSampler) sample(x, y int) (int16, bool) {
+	cell_x := floorDiv(x, CELL_DIV)
+	cell_y := floorDiv(y, CELL_DIV)
+	c := ds.cell(int16(-cell_y-1), int16(cell_x))
+	if !c.received {
+		return math.MinInt16, false
+	}
+	elevation := c.data[(y-cell_y*CELL_DIV)*CELL_SIZE+(x-cell_x*CELL_DIV)]
+	return elevation, elevation != math.MinInt16
+}
+
+// swbd returns the SWBD mask at a global index, counted like sample but with CELL_SWBD_DIV samples per degree.
+// The SRTM sample (x, y) lies on the SWBD sample (3x, 3y).
+func (ds *demSampler) swbd(x, y int) bool {
+	cell_x := floorDiv(x, CELL_SWBD_DIV)
+	cell_y := floorDiv(y, CELL_SWBD_DIV)
+	c := ds.cell(int16(-cell_y-1), int16(cell_x))
+	if !c.received {
+		return false
+	}
+	i := (y-cell_y*CELL_SWBD_DIV)*CELL_SWBD_SIZE + (x - cell_x*CELL_SWBD_DIV)
+	return c.water[i/64]&(1<<uint(i%64)) != 0
+}
+
+// kernelWeight returns the weight of a sample at distance d (in samples) for the current resampling style.
+func kernelWeight(d float64) float64 {
+	d = math.Abs(d)
+	switch resampling_style {
+	case Bilinear:
+		if d < 1 {
+			return 1 - d
+		}
+	case Bicubic:
+		// Keys cubic convolution with a = -0.5
+		if d < 1 {
+			return 1.5*d*d*d - 2.5*d*d + 1
+		} else if d < 2 {
+			return -0.5*d*d*d + 2.5*d*d - 4*d + 2
+		}
+	case Lanczos:
+		// Lanczos with a = 3
+		if d == 0 {
+			return 1
+		} else if d < 3 {
+			return 3 * math.Sin(math.Pi*d) * math.Sin(math.Pi*d/3) / (math.Pi * math.Pi * d * d)
+		}
+	}
+	return 0
+}
+
+// kernelRadius is the number of samples on each side of the point read by the current resampling style.
+func kernelRadius() int {
+	switch resampling_style {
+	case Bilinear:
+		return 1
+	case Bicubic:
+		return 2
+	case Lanczos:
+		return 3
+	}
+	return 0
+}
+
+// elevation returns the interpolated elevation at (lat, lon), NaN for a point without data.
+func (ds *demSampler) elevation(lat, lon float64) float64 {
+	fx := lon * float64(CELL_DIV)
+	fy := -lat * float64(CELL_DIV)
+	nearest, ok := ds.sample(int(math.Floor(fx+0.5)), int(math.Floor(fy+0.5)))
+	if !ok {
+		return math.NaN()
+	}
+	if resampling_style == Nearest {
+		return float64(nearest)
+	}
+
+	// voids and missing cells in the neighbourhood are replaced by the nearest sample
+	radius := kernelRadius()
+	x0 := int(math.Floor(fx))
+	y0 := int(math.Floor(fy))
+	var sum, weight_sum float64
+	for y := y0 - radius + 1; y <= y0+radius; y++ {
+		wy := kernelWeight(fy - float64(y))
+		if wy == 0 {
+			continue
+		}
+		for x := x0 - radius + 1; x <= x0+radius; x++ {
+			w := wy * kernelWeight(fx-float64(x))
+			if w == 0 {
+				continue
+			}
+			value, ok := ds.sample(x, y)
+			if !ok {
+				value = nearest
+			}
+			sum += w * float64(value)
+			weight_sum += w
+		}
+	}
+	if weight_sum == 0 {
+		return float64(nearest)
+	}
+	return sum / weight_sum
+}
+
+// waterCoverage returns the share of the 1 arc second SWBD samples inside the footprint that are water.
+// A footprint smaller than one SWBD sample reads the sample under its centre.
+func (ds *demSampler) waterCoverage(lat, lon float64, footprint mapRectangle) float64 {
+	x_min := int(math.Ceil(footprint.West * float64(CELL_SWBD_DIV)))
+	x_max := int(math.Ceil(footprint.East*float64(CELL_SWBD_DIV))) - 1
+	y_min := int(math.Ceil(-footprint.North * float64(CELL_SWBD_DIV)))
+	y_max := int(math.Ceil(-footprint.South*float64(CELL_SWBD_DIV))) - 1
+	if x_max < x_min || y_max < y_min {
+		if ds.swbd(int(math.Floor(lon*float64(CELL_SWBD_DIV))), int(math.Floor(-lat*float64(CELL_SWBD_DIV)))) {
+			return 1
+		}
+		return 0
+	}
+	var water int
+	for y := y_min; y <= y_max; y++ {
+		for x := x_min; x <= x_max; x++ {
+			if ds.swbd(x, y) {
+				water++
+			}
+		}
+	}
+	return float64(water) / float64((x_max-x_min+1)*(y_max-y_min+1))
+}
+
+// pixelElevation returns the elevation of an output pixel centred on (lat, lon) whose footprint on the ground
+// is given in degrees, and the share of the footprint covered by water. With a filter, the land samples inside
+// the footprint are averaged. Land without any data is NaN.
+func (ds *demSampler) pixelElevation(lat, lon float64, footprint mapRectangle) (float64, float64) {
+	coverage := ds.waterCoverage(lat, lon, footprint)
+	if downsampling_style == PointSampling {
+		return ds.elevation(lat, lon), coverage
+	}
+	half_x := (footprint.East - footprint.West) / 2
+	half_y := (footprint.North - footprint.South) / 2
+	west, east, south, north := footprint.West, footprint.East, footprint.South, footprint.North
+	if downsampling_style == GaussianFilter {
+		// sigma is half a pixel, the window reaches two sigma
+		west, east, south, north = west-half_x, east+half_x, south-half_y, north+half_y
+	}
+	x_min := int(math.Ceil(west * float64(CELL_DIV)))
+	x_max := int(math.Ceil(east*float64(CELL_DIV))) - 1
+	y_min := int(math.Ceil(-north * float64(CELL_DIV)))
+	y_max := int(math.Ceil(-south*float64(CELL_DIV))) - 1
+
+	var land_sum, land_weight float64
+	for y := y_min; y <= y_max; y++ {
+		for x := x_min; x <= x_max; x++ {
+			if ds.swbd(3*x, 3*y) {
+				continue
+			}
+			elevation, ok := ds.sample(x, y)
+			if !ok {
+				continue
+			}
+			w := 1.0
+			if downsampling_style == GaussianFilter {
+				dx := (float64(x)/float64(CELL_DIV) - lon) / half_x
+				dy := (-float64(y)/float64(CELL_DIV) - lat) / half_y
+				w = math.Exp(-(dx*dx + dy*dy) / 2)
+			}
+			land_sum += w * float64(elevation)
+			land_weight += w
+		}
+	}
+	if land_weight == 0 {
+		// the pixel is smaller than the DEM spacing, or its land is too small to hold a sample
+		return ds.elevation(lat, lon), coverage
+	}
+	return land_sum / land_weight, coverage
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKernelWeight(t *testing.T) {
+	defer func(s resampling) { resampling_style = s }(resampling_style)
+	tests := []struct {
+		style resampling
+		d     float64
+		want  float64
+	}{
+		{Bilinear, 0, 1},
+		{Bilinear, 0.25, 0.75},
+		{Bilinear, -0.5, 0.5},
+		{Bilinear, 1, 0},
+		{Bicubic, 0, 1},
+		{Bicubic, 0.5, 0.5625},
+		{Bicubic, 1, 0},
+		{Bicubic, 1.5, -0.0625},
+		{Bicubic, -1.5, -0.0625},
+		{Bicubic, 2, 0},
+		{Lanczos, 0, 1},
+		{Lanczos, 1, 0},
+		{Lanczos, 2, 0},
+		{Lanczos, 0.5, 3 * math.Sin(math.Pi/2) * math.Sin(math.Pi/6) / (math.Pi * math.Pi / 4)},
+		{Lanczos, 3, 0},
+		{Nearest, 0, 0},
+	}
+	for _, tt := range tests {
+		resampling_style = tt.style
+		if got := kernelWeight(tt.d); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("style %d: kernelWeight(%g) = %g, want %g", tt.style, tt.d, got, tt.want)
+		}
+	}
+}
+
+// The interpolating kernels sum to one over the samples of their window, so flat terrain stays flat.
+func TestKernelPartitionOfUnity(t *testing.T) {
+	defer func(s resampling) { resampling_style = s }(resampling_style)
+	tests := []struct {
+		style     resampling
+		radius    int
+		tolerance float64
+	}{
+		{Bilinear, 1, 1e-12},
+		{Bicubic, 2, 1e-12},
+		// Lanczos only comes close; the sampler divides by the sum of the weights
+		{Lanczos, 3, 0.02},
+	}
+	for _, tt := range tests {
+		resampling_style = tt.style
+		if got := kernelRadius(); got != tt.radius {
+			t.Errorf("style %d: kernelRadius() = %d, want %d", tt.style, got, tt.radius)
+		}
+		for _, f := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9} {
+			sum := 0.0
+			for k := -tt.radius; k <= tt.radius; k++ {
+				sum += kernelWeight(f - float64(k))
+			}
+			if math.Abs(sum-1) > tt.tolerance {
+				t.Errorf("style %d: weights at offset %g sum to %g", tt.style, f, sum)
+			}
+			// nothing outside the window
+			if w := kernelWeight(f + float64(tt.radius) + 1e-9); f > 0 && w != 0 {
+				t.Errorf("style %d: kernelWeight(%g) = %g outside the radius", tt.style, f+float64(tt.radius), w)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// squirrelString quotes s as a Squirrel string literal.
+func squirrelString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// scaleCities returns the towns inside the map and area with their population scaled for the game, largest first.
+// With target above zero the populations are scaled so that their sum is target, otherwise by scale.
+// No town gets fewer than minimum citizens.
+func scaleCities(points []mapPoint, proj projection, target, scale, minimum float64) []mapPoint {
+	var cities []mapPoint
+	total := 0.0
+	for _, p := range points {
+		if where := p.outside(proj); where != "" {
+			fmt.Fprintf(os.Stderr, "%q is outside the %s, left out\n", p.name, where)
+			continue
+		}
+		cities = append(cities, p)
+		total += p.population
+	}
+	if target > 0 && total > 0 {
+		scale = target / total
+	}
+	for i := range cities {
+		cities[i].population = math.Max(minimum, math.Floor(0.5+cities[i].population*scale))
+	}
+	sort.SliceStable(cities, func(i, j int) bool { return cities[i].population > cities[j].population })
+	fmt.Fprintf(os.Stderr, "%d towns, real population scaled by %g\n", len(cities), scale)
+	return cities
+}
+
+// writeScenario writes a Simutrans scenario skeleton that founds the towns at their tiles when it starts
+// and lists the stations for the rest of the script.
+func writeScenario(name, savegame string, cities, stations []mapPoint) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Scenario skeleton written by simumap %s.\n", version)
+	fmt.Fprintf(&buf, "// Create a map from the heightmap, save it as %s next to this file, then start the scenario.\n\n", savegame)
+	fmt.Fprintf(&buf, "map.file = %s\n\n", squirrelString(savegame))
+	fmt.Fprintf(&buf, "scenario.short_description = %s\n", squirrelString(name))
+	buf.WriteString("scenario.author = \"\"\n")
+	buf.WriteString("scenario.version = \"1\"\n\n")
+
+	buf.WriteString("// towns in the order they are founded, largest first\n")
+	buf.WriteString("cities <- [\n")
+	for _, c := range cities {
+		tx, ty := c.tile()
+		fmt.Fprintf(&buf, "\t{ name = %s, x = %d, y = %d, population = %d },\n", squirrelString(c.name), tx, ty, int(c.population))
+	}
+	buf.WriteString("]\n\n")
+	buf.WriteString("// stations at their real places, for building the network\n")
+	buf.WriteString("stations <- [\n")
+	for _, s := range stations {
+		tx, ty := s.tile()
+		fmt.Fprintf(&buf, "\t{ name = %s, x = %d, y = %d },\n", squirrelString(s.name), tx, ty)
+	}
+	buf.WriteString("]\n\n")
+
+	buf.WriteString(`function get_rule_text(pl)
+{
+	return ttext("No rules.")
+}
+
+function get_goal_text(pl)
+{
+	return ttext("Connect the towns.")
+}
+
+function get_info_text(pl)
+{
+	return ttext(scenario.short_description)
+}
+
+function get_result_text(pl)
+{
+	return ttext("")
+}
+
+function is_scenario_completed(pl)
+{
+	return 0
+}
+
+function start()
+{
+	local public_player = player_x(1)
+	foreach (c in cities) {
+		local tile = square_x(c.x, c.y).get_ground_tile()
+		local err = command_x(tool_add_city).work(public_player, tile, c.population.tostring())
+		if (err != null) {
+			print("could not found " + c.name + ": " + err)
+			continue
+		}
+		city_x(c.x, c.y).set_name(c.name)
+	}
+}
+`)
+	return buf.Bytes()
+}
+
+// scenarioCommand is the "scenario" subcommand, which writes a .nut scenario skeleton for a rendered map
+// with the towns of a gazetteer CSV (name, lat, lon, population) founded at their projected tiles.
+func scenarioCommand(args []string) {
+	flags := flag.NewFlagSet("scenario", flag.ExitOnError)
+	meta := flags.String("m", "", "sidecar .meta.json written with the map")
+	config := flags.String("f", "", "config file of the map, when there is no sidecar")
+	gazetteer := flags.String("i", "", "CSV of towns with name, lat, lon and population columns")
+	stops := flags.String("stations", "", "GTFS stops.txt or CSV of stations to list in the script")
+	output := flags.String("o", "", "scenario to write, the map name with .nut when empty")
+	target := flags.Float64("population", 0, "total population of the towns in the game, 0 to use -scale")
+	scale := flags.Float64("scale", 1, "factor from real to game population")
+	minimum := flags.Float64("min", 100, "smallest population of a town in the game")
+	flags.Parse(args)
+
+	var proj projection
+	var image_file string
+	switch {
+	case *meta != "":
+		proj, image_file = projectionFromMetadata(*meta)
+	case *config != "":
+		proj, image_file, _ = projectionFromConfig(*config)
+	}
+	if proj == nil || *gazetteer == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := strings.TrimSuffix(filepath.Base(image_file), filepath.Ext(image_file))
+	if *output == "" {
+		*output = strings.TrimSuffix(image_file, filepath.Ext(image_file)) + ".nut"
+	}
+
+	cities := scaleCities(readPointsCSV(*gazetteer, proj), proj, *target, *scale, *minimum)
+	var stations []mapPoint
+	if *stops != "" {
+		for _, s := range readPointsCSV(*stops, proj) {
+			if s.outside(proj) != "map" {
+				stations = append(stations, s)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(*output, writeScenario(name, name+".sve", cities, stations), 0666); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("scenario:", *output)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// slopeLimit describes the largest difference in levels allowed between neighbouring tiles.
+// Neighbours is 4 or 8.
+type slopeLimit struct {
+	Maxdiff    int
+	Neighbours int
+}
+
+// levelGrid is the level of each pixel, counted in order of elevation in the level table.
+// -1 marks pixels without data.
+type levelGrid struct {
+	ranges []level
+	level  []int
+}
+
+func newLevelGrid(hm *heightMap) levelGrid {
+	var lg levelGrid
+	lg.ranges = append([]level(nil), elevation_level...)
+	sort.SliceStable(lg.ranges, func(i, j int) bool { return lg.ranges[i].Min < lg.ranges[j].Min })
+	lg.level = make([]int, len(hm.elevation))
+	for i := range hm.elevation {
+		lg.level[i] = -1
+		if !hm.water[i] && math.IsNaN(float64(hm.elevation[i])) {
+			continue
+		}
+		e := hm.level(i)
+		for k, r := range lg.ranges {
+			if e >= r.Min && e <= r.Max {
+				lg.level[i] = k
+				break
+			}
+		}
+	}
+	return lg
+}
+
+// limitSlope changes the levels of land tiles so that neighbours differ by at most sl.Maxdiff levels.
+// Land is first raised around every tile that stands too high above its neighbours, which keeps peaks
+// and only fills valleys and cliff feet. Then land is lowered where it still stands too high above water,
+// since water is never changed. Changed tiles get the elevation of the nearest end of their new level.
+func (hm *heightMap) limitSlope(sl slopeLimit) {
+	if len(elevation_level) == 0 {
+		log.Fatalln("elevation.slopelimit needs a level table")
+	}
+	maxdiff := sl.Maxdiff
+	if maxdiff <= 0 {
+		maxdiff = 1
+	}
+	var neighbours [][2]int
+	switch sl.Neighbours {
+	case 4:
+		neighbours = [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}}
+	case 8, 0:
+		neighbours = [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}, {-1, -1}, {1, -1}, {-1, 1}, {1, 1}}
+	default:
+		log.Fatalf("elevation.slopelimit: neighbours must be 4 or 8, got %d\n", sl.Neighbours)
+	}
+
+	lg := newLevelGrid(hm)
+	original := append([]int(nil), lg.level...)
+	// relax repeats update over the grid, forward and backward, until nothing changes
+	relax := func(update func(i, neighbour int) bool) {
+		for changed := true; changed; {
+			changed = false
+			for pass := 0; pass < 2; pass++ {
+				for n := 0; n < len(lg.level); n++ {
+					i := n
+					if pass == 1 {
+						i = len(lg.level) - 1 - n
+					}
+					if hm.water[i] || lg.level[i] < 0 {
+						continue
+					}
+					x, y := i%hm.width, i/hm.width
+					for _, d := range neighbours {
+						nx, ny := x+d[0], y+d[1]
+						if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+							continue
+						}
+						j := ny*hm.width + nx
+						if lg.level[j] >= 0 && update(i, j) {
+							changed = true
+						}
+					}
+				}
+			}
+		}
+	}
+	relax(func(i, j int) bool {
+		if lg.level[j]-maxdiff > lg.level[i] {
+			lg.level[i] = lg.level[j] - maxdiff
+			return true
+		}
+		return false
+	})
+	relax(func(i, j int) bool {
+		if lg.level[j]+maxdiff < lg.level[i] {
+			lg.level[i] = lg.level[j] + maxdiff
+			return true
+		}
+		return false
+	})
+
+	var raised, lowered, steep int
+	for i, k := range lg.level {
+		if k < 0 {
+			continue
+		}
+		if k > original[i] {
+			raised++
+			hm.elevation[i] = float32(lg.ranges[k].Min)
+		} else if k < original[i] {
+			lowered++
+			hm.elevation[i] = float32(lg.ranges[k].Max)
+		}
+		if !hm.water[i] {
+			continue
+		}
+		// water next to water that is much lower can not be fixed
+		x, y := i%hm.width, i/hm.width
+		for _, d := range neighbours {
+			nx, ny := x+d[0], y+d[1]
+			if nx >= 0 && ny >= 0 && nx < hm.width && ny < hm.height {
+				if l := lg.level[ny*hm.width+nx]; l >= 0 && k-l > maxdiff {
+					steep++
+					break
+				}
+			}
+		}
+	}
+	fmt.Printf("slope limit: %d tiles raised, %d tiles lowered, %d water tiles still too steep\n", raised, lowered, steep)
+}
+
+// elevationFilter is one smoothing step applied to the land before quantization.
+// Radius is in pixels, or Distance in metres when given. Range is the elevation difference in metres
+// that the bilateral filter still treats as the same surface, Relief the largest relief in metres
+// of a plain that the flatten filter snaps to a single height.
+type elevationFilter struct {
+	Type     string
+	Radius   float64
+	Distance float64
+	Range    float64
+	Relief   float64
+}
+
+// filterElevation applies the filters in order. Water and pixels without data are left alone and never
+// enter the neighbourhood of a land pixel. A Distance is turned into pixels row by row with the ground size
+// of the pixels of proj, which shrinks towards the poles.
+func (hm *heightMap) filterElevation(filters []elevationFilter, proj projection) {
+	for _, f := range filters {
+		radius := make([]float64, hm.height)
+		for y := range radius {
+			radius[y] = f.Radius
+			if f.Distance > 0 {
+				radius[y] = f.Distance / pixelSize(proj, float64(hm.width-1)/2, float64(y))
+			}
+			if radius[y] <= 0 {
+				log.Fatalf("elevation.filters: %s needs a positive radius or distance\n", f.Type)
+			}
+		}
+		window := func(factor float64) []int {
+			w := make([]int, hm.height)
+			for y := range w {
+				w[y] = int(math.Ceil(factor * radius[y]))
+			}
+			return w
+		}
+		switch strings.ToLower(f.Type) {
+		case "gaussian":
+			hm.gaussianFilter(radius)
+		case "median":
+			hm.windowFilter(window(1), func(y int, center float64, values, weights []float64) float64 {
+				sort.Float64s(values)
+				return values[len(values)/2]
+			})
+		case "bilateral":
+			if f.Range <= 0 {
+				log.Fatalln("elevation.filters: bilateral needs a positive range")
+			}
+			hm.bilateralFilter(radius, f.Range)
+		case "flatten":
+			if f.Relief <= 0 {
+				log.Fatalln("elevation.filters: flatten needs a positive relief")
+			}
+			hm.flattenPlains(window(1), f.Relief)
+		default:
+			log.Fatalf("elevation.filters: unknown filter %q\n", f.Type)
+		}
+	}
+}
+
+// isLand tells whether pixel i takes part in the elevation filters.
+func (hm *heightMap) isLand(i int) bool {
+	return !hm.water[i] && !math.IsNaN(float64(hm.elevation[i]))
+}
+
+// windowFilter replaces every land pixel by reduce over the land pixels in the square window of radius
+// window[y] around it. weights holds the distance of each value from the centre in pixels.
+func (hm *heightMap) windowFilter(window []int, reduce func(y int, center float64, values, weights []float64) float64) {
+	result := append([]float32(nil), hm.elevation...)
+	var values, weights []float64
+	for y := 0; y < hm.height; y++ {
+		r := window[y]
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			if !hm.isLand(i) {
+				continue
+			}
+			values, weights = values[:0], weights[:0]
+			for wy := intMax(0, y-r); wy <= intMin(hm.height-1, y+r); wy++ {
+				for wx := intMax(0, x-r); wx <= intMin(hm.width-1, x+r); wx++ {
+					j := wy*hm.width + wx
+					if hm.isLand(j) {
+						values = append(values, float64(hm.elevation[j]))
+						weights = append(weights, math.Hypot(float64(wx-x), float64(wy-y)))
+					}
+				}
+			}
+			result[i] = float32(reduce(y, float64(hm.elevation[i]), values, weights))
+		}
+	}
+	hm.elevation = result
+}
+
+// gaussianFilter blurs the land with a separable Gaussian of sigma[y] pixels on row y.
+func (hm *heightMap) gaussianFilter(sigma []float64) {
+	kernels := make(map[float64][]float64)
+	kernel := func(y int) []float64 {
+		s := sigma[y]
+		if k, ok := kernels[s]; ok {
+			return k
+		}
+		r := int(math.Ceil(3 * s))
+		k := make([]float64, 2*r+1)
+		for d := -r; d <= r; d++ {
+			k[d+r] = math.Exp(-float64(d*d) / (2 * s * s))
+		}
+		kernels[s] = k
+		return k
+	}
+	pass := func(dx, dy int) {
+		result := append([]float32(nil), hm.elevation...)
+		for y := 0; y < hm.height; y++ {
+			kn := kernel(y)
+			r := len(kn) / 2
+			for x := 0; x < hm.width; x++ {
+				i := y*hm.width + x
+				if !hm.isLand(i) {
+					continue
+				}
+				var sum, weight float64
+				for k := -r; k <= r; k++ {
+					nx, ny := x+k*dx, y+k*dy
+					if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+						continue
+					}
+					j := ny*hm.width + nx
+					if hm.isLand(j) {
+						sum += kn[k+r] * float64(hm.elevation[j])
+						weight += kn[k+r]
+					}
+				}
+				result[i] = float32(sum / weight)
+			}
+		}
+		hm.elevation = result
+	}
+	pass(1, 0)
+	pass(0, 1)
+}
+
+// bilateralFilter blurs the land with a Gaussian of sigma[y] pixels on row y, weighting neighbours down when
+// their elevation differs by more than about value_range metres, so that ridges and cliffs stay sharp.
+func (hm *heightMap) bilateralFilter(sigma []float64, value_range float64) {
+	window := make([]int, hm.height)
+	for y := range window {
+		window[y] = int(math.Ceil(2 * sigma[y]))
+	}
+	hm.windowFilter(window, func(y int, center float64, values, weights []float64) float64 {
+		var sum, weight float64
+		s := sigma[y]
+		for k, v := range values {
+			w := math.Exp(-weights[k]*weights[k]/(2*s*s) - (v-center)*(v-center)/(2*value_range*value_range))
+			sum += w * v
+			weight += w
+		}
+		return sum / weight
+	})
+}
+
+// flattenPlains snaps every plain to a single height, its mean. A land pixel is flat when the land in the
+// window of radius window[y] around it varies by at most relief metres. Plains are grown over 4-connected
+// flat pixels from the lowest one not yet taken, as long as the whole plain stays within relief, so a gentle
+// slope becomes terraces instead of one wide step.
+func (hm *heightMap) flattenPlains(window []int, relief float64) {
+	var flat []int
+	for y := 0; y < hm.height; y++ {
+		r := window[y]
+		for x := 0; x < hm.width; x++ {
+			i := y*hm.width + x
+			if !hm.isLand(i) {
+				continue
+			}
+			low, high := math.Inf(1), math.Inf(-1)
+			for wy := intMax(0, y-r); wy <= intMin(hm.height-1, y+r); wy++ {
+				for wx := intMax(0, x-r); wx <= intMin(hm.width-1, x+r); wx++ {
+					if j := wy*hm.width + wx; hm.isLand(j) {
+						e := float64(hm.elevation[j])
+						low, high = math.Min(low, e), math.Max(high, e)
+					}
+				}
+			}
+			if high-low <= relief {
+				flat = append(flat, i)
+			}
+		}
+	}
+	sort.SliceStable(flat, func(a, b int) bool { return hm.elevation[flat[a]] < hm.elevation[flat[b]] })
+
+	const free, taken = 1, 2
+	state := make([]int8, len(hm.elevation))
+	for _, i := range flat {
+		state[i] = free
+	}
+	plains, pixels := 0, 0
+	for _, start := range flat {
+		if state[start] != free {
+			continue
+		}
+		state[start] = taken
+		low := float64(hm.elevation[start])
+		plain := []int{start}
+		sum := low
+		for k := 0; k < len(plain); k++ {
+			x, y := plain[k]%hm.width, plain[k]/hm.width
+			for _, d := range d4 {
+				nx, ny := x+d[0], y+d[1]
+				if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+					continue
+				}
+				j := ny*hm.width + nx
+				// plains start at their lowest pixel, so only the rise above it is checked
+				if state[j] == free && float64(hm.elevation[j])-low <= relief {
+					state[j] = taken
+					plain = append(plain, j)
+					sum += float64(hm.elevation[j])
+				}
+			}
+		}
+		if len(plain) < 2 {
+			continue
+		}
+		mean := float32(sum / float64(len(plain)))
+		for _, i := range plain {
+			hm.elevation[i] = mean
+		}
+		plains++
+		pixels += len(plain)
+	}
+	fmt.Printf("flatten: %d plains, %d pixels snapped\n", plains, pixels)
+}
+
+// elevationTransform remaps the land elevation in metres before the level lookup, so that one level table
+// fits maps of different scales. The steps are applied in order: Offset is subtracted to move the sea level,
+// the height above water is multiplied by Scale and bent by Gamma relative to Top (an elevation of the map
+// before the transform, the highest land when zero), Curve maps the result piecewise linearly, and Min and Max clamp it.
+type elevationTransform struct {
+	Offset float64
+	Scale  float64
+	Gamma  float64
+	Top    float64
+	Curve  []curvePoint
+	Min    *float64
+	Max    *float64
+}
+
+// curvePoint maps the elevation From to To. Between points the curve is linear, beyond the ends it is flat.
+type curvePoint struct {
+	From float64
+	To   float64
+}
+
+// transformElevation applies the transform to every land pixel. Water is left at the water level.
+func (hm *heightMap) transformElevation(t elevationTransform) {
+	scale := t.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	if scale < 0 || t.Gamma < 0 {
+		log.Fatalln("elevation.transform: scale and gamma must be positive")
+	}
+	curve := append([]curvePoint(nil), t.Curve...)
+	sort.SliceStable(curve, func(i, j int) bool { return curve[i].From < curve[j].From })
+	water := float64(water_level)
+
+	// top is the elevation of the map given in Top, or the highest land when unset, offset and scaled like h below
+	var top float64
+	if t.Top != 0 {
+		top = (t.Top - t.Offset - water) * scale
+	} else if t.Gamma > 0 {
+		for i, e := range hm.elevation {
+			if hm.isLand(i) {
+				top = math.Max(top, (float64(e)-t.Offset-water)*scale)
+			}
+		}
+	}
+
+	for i, e := range hm.elevation {
+		if !hm.isLand(i) {
+			continue
+		}
+		h := (float64(e) - t.Offset - water) * scale
+		if t.Gamma > 0 && top > 0 && h > 0 {
+			h = top * math.Pow(h/top, t.Gamma)
+		}
+		v := water + h
+		if len(curve) > 0 {
+			v = curveValue(curve, v)
+		}
+		if t.Min != nil {
+			v = math.Max(v, *t.Min)
+		}
+		if t.Max != nil {
+			v = math.Min(v, *t.Max)
+		}
+		hm.elevation[i] = float32(v)
+	}
+}
+
+// curveValue evaluates the piecewise linear curve, whose points are sorted by From, at e.
+func curveValue(curve []curvePoint, e float64) float64 {
+	if e <= curve[0].From {
+		return curve[0].To
+	}
+	for k := 1; k < len(curve); k++ {
+		a, b := curve[k-1], curve[k]
+		if e > b.From {
+			continue
+		}
+		return a.To + (b.To-a.To)*(e-a.From)/(b.From-a.From)
+	}
+	return curve[len(curve)-1].To
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTransformElevationTop(t *testing.T) {
+	defer func(w int16) { water_level = w }(water_level)
+	water_level = 0
+	// setting top to the highest land of the map gives the same curve as leaving it unset
+	for _, tt := range []elevationTransform{
+		{Gamma: 0.5},
+		{Gamma: 0.5, Scale: 2},
+		{Gamma: 2, Offset: 10, Scale: 0.5},
+	} {
+		unset := rampHeightMap(100)
+		unset.transformElevation(tt)
+		tt.Top = 100
+		set := rampHeightMap(100)
+		set.transformElevation(tt)
+		for i := 0; i < 100; i++ {
+			if math.Abs(float64(set.elevation[i]-unset.elevation[i])) > 1e-3 {
+				t.Errorf("%+v: pixel %d is %v with top and %v without", tt, i, set.elevation[i], unset.elevation[i])
+				break
+			}
+		}
+	}
+
+	// the top of the map stays at its scaled height and the middle is bent by gamma
+	hm := rampHeightMap(100)
+	hm.transformElevation(elevationTransform{Scale: 2, Gamma: 0.5, Top: 100})
+	if e := hm.elevation[99]; math.Abs(float64(e)-200) > 1e-3 {
+		t.Errorf("top at %v, want 200", e)
+	}
+	if e, want := hm.elevation[24], 200*math.Sqrt(0.25); math.Abs(float64(e)-want) > 1e-3 {
+		t.Errorf("quarter height at %v, want %v", e, want)
+	}
+	if !hm.water[100] || hm.elevation[100] != 0 {
+		t.Errorf("water changed to %v", hm.elevation[100])
+	}
+}
+
+// gridHeightMap returns a heightMap of land with the elevations given row by row.
+func gridHeightMap(width int, elevation ...float32) *heightMap {
+	hm := newHeightMap(width, len(elevation)/width)
+	copy(hm.elevation, elevation)
+	return hm
+}
+
+func TestFlattenPlains(t *testing.T) {
+	// two noisy plains at 10 and 50 m joined by a slope in columns 3 to 6
+	hm := gridHeightMap(10,
+		10.2, 9.8, 10.4, 10, 20, 35, 50, 50.3, 49.6, 50,
+		9.9, 10.1, 10.3, 10, 20, 35, 50, 50.1, 49.9, 50.4,
+		10, 10.5, 9.7, 10, 20, 35, 50, 49.8, 50.2, 50,
+	)
+	original := append([]float32(nil), hm.elevation...)
+	hm.flattenPlains([]int{1, 1, 1}, 2)
+	for _, plain := range [][]int{{0, 1, 2}, {7, 8, 9}} {
+		var sum float64
+		for y := 0; y < 3; y++ {
+			for _, x := range plain {
+				sum += float64(original[y*10+x])
+			}
+		}
+		mean := float32(sum / 9)
+		for y := 0; y < 3; y++ {
+			for _, x := range plain {
+				if e := hm.elevation[y*10+x]; math.Abs(float64(e-mean)) > 1e-4 {
+					t.Errorf("pixel %d,%d at %v, want the plain mean %v", x, y, e, mean)
+				}
+			}
+		}
+	}
+	// the slope is not flat at a radius of 1
+	for y := 0; y < 3; y++ {
+		for x := 3; x <= 6; x++ {
+			if i := y*10 + x; hm.elevation[i] != original[i] {
+				t.Errorf("slope pixel %d,%d moved from %v to %v", x, y, original[i], hm.elevation[i])
+			}
+		}
+	}
+
+	// a gentle slope becomes terraces whose plains each stay within the relief
+	ramp := newHeightMap(12, 1)
+	for i := range ramp.elevation {
+		ramp.elevation[i] = float32(i) / 2
+	}
+	ramp.flattenPlains([]int{1}, 1.5)
+	for i := 0; i < 12; i++ {
+		want := float32(i/4*2) + 0.75
+		if ramp.elevation[i] != want {
+			t.Errorf("ramp pixel %d at %v, want %v", i, ramp.elevation[i], want)
+		}
+	}
+}
+
+func TestLimitSlope(t *testing.T) {
+	defer func(l []level, w int16) { elevation_level, water_level = l, w }(elevation_level, water_level)
+	water_level = 0
+	// level k covers 10k-9 to 10k metres
+	elevation_level = []level{{Min: math.MinInt16, Max: 0}}
+	for k := 1; k < 10; k++ {
+		elevation_level = append(elevation_level, level{Min: int16(10*k - 9), Max: int16(10 * k)})
+	}
+	elevation_level[9].Max = math.MaxInt16
+
+	for _, sl := range []slopeLimit{{Maxdiff: 1, Neighbours: 8}, {Maxdiff: 1, Neighbours: 4}, {Maxdiff: 2, Neighbours: 8}} {
+		// a peak five tiles from the sea on the left and a cliff at the right
+		hm := gridHeightMap(8,
+			0, 5, 5, 5, 5, 5, 5, 85,
+			0, 5, 5, 15, 5, 5, 5, 85,
+			0, 15, 5, 5, 5, 75, 5, 85,
+			0, 5, 5, 5, 5, 5, 5, 85,
+		)
+		for y := 0; y < hm.height; y++ {
+			hm.water[y*hm.width] = true
+		}
+		hm.limitSlope(sl)
+		lg := newLevelGrid(hm)
+		neighbours := d8[:]
+		if sl.Neighbours == 4 {
+			neighbours = d8[:4]
+		}
+		for i, k := range lg.level {
+			x, y := i%hm.width, i/hm.width
+			for _, d := range neighbours {
+				nx, ny := x+d[0], y+d[1]
+				if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+					continue
+				}
+				if l := lg.level[ny*hm.width+nx]; k-l > sl.Maxdiff {
+					t.Errorf("%+v: level %d at %d,%d next to level %d at %d,%d", sl, k, x, y, l, nx, ny)
+				}
+			}
+		}
+		// the peak is kept unless it stands too high above the water, and the water is not changed
+		if k, want := lg.level[2*hm.width+5], intMin(8, 5*sl.Maxdiff); k != want {
+			t.Errorf("%+v: peak at level %d, want %d", sl, k, want)
+		}
+		for y := 0; y < hm.height; y++ {
+			if i := y * hm.width; !hm.water[i] || hm.elevation[i] != 0 {
+				t.Errorf("%+v: water at 0,%d changed", sl, y)
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// waterMask describes the clean-up of the water mask after rendering.
+// Dilate grows and Erode shrinks the water by a radius in pixels. Islands and lakes smaller than
+// Minisland and Minlake pixels are removed, except islands holding one of the Keep points.
+// Diagonals decides what happens where water or land touches only at a corner: "water" opens a
+// proper channel, "land" closes it.
+type waterMask struct {
+	Dilate    int
+	Erode     int
+	Minisland int
+	Minlake   int
+	Diagonals string
+	Keep      []namedPoint
+}
+
+// namedPoint is a named place given by latitude and longitude.
+type namedPoint struct {
+	Name string
+	Lat  float64
+	Lon  float64
+}
+
+var d4 = [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}}
+
+// setWater turns pixel i into water or land. New land gets the mean elevation of the land around it.
+func (hm *heightMap) setWater(i int, water bool) {
+	if hm.water[i] == water {
+		return
+	}
+	hm.water[i] = water
+	if water {
+		hm.elevation[i], hm.coverage[i] = float32(water_level), 1
+		return
+	}
+	hm.coverage[i] = 0
+	x, y := i%hm.width, i/hm.width
+	var sum float64
+	var n int
+	for _, d := range d8 {
+		nx, ny := x+d[0], y+d[1]
+		if nx >= 0 && ny >= 0 && nx < hm.width && ny < hm.height && hm.isLand(ny*hm.width+nx) {
+			sum += float64(hm.elevation[ny*hm.width+nx])
+			n++
+		}
+	}
+	if n > 0 {
+		hm.elevation[i] = float32(sum / float64(n))
+	} else {
+		hm.elevation[i] = float32(water_level) + 1
+	}
+}
+
+// morphWater grows (water true) or shrinks (water false) the water by radius pixels with a disc.
+func (hm *heightMap) morphWater(radius int, water bool) int {
+	var change []int
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			if hm.water[y*hm.width+x] == water {
+				continue
+			}
+		search:
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					nx, ny := x+dx, y+dy
+					if dx*dx+dy*dy > radius*radius || nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+						continue
+					}
+					if hm.water[ny*hm.width+nx] == water {
+						change = append(change, y*hm.width+x)
+						break search
+					}
+				}
+			}
+		}
+	}
+	for _, i := range change {
+		hm.setWater(i, water)
+	}
+	return len(change)
+}
+
+// components labels the 4-connected regions of water (water true) or land and returns the pixels of each.
+func (hm *heightMap) components(water bool) [][]int {
+	label := make([]bool, len(hm.water))
+	var regions [][]int
+	for start := range hm.water {
+		if label[start] || hm.water[start] != water {
+			continue
+		}
+		label[start] = true
+		region := []int{start}
+		for k := 0; k < len(region); k++ {
+			x, y := region[k]%hm.width, region[k]/hm.width
+			for _, d := range d4 {
+				nx, ny := x+d[0], y+d[1]
+				if nx < 0 || ny < 0 || nx >= hm.width || ny >= hm.height {
+					continue
+				}
+				j := ny*hm.width + nx
+				if !label[j] && hm.water[j] == water {
+					label[j] = true
+					region = append(region, j)
+				}
+			}
+		}
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// fixDiagonals resolves 2x2 blocks where two water pixels touch only at a corner.
+func (hm *heightMap) fixDiagonals(to_water bool) int {
+	changed := 0
+	for pass := 0; pass < 16; pass++ {
+		found := 0
+		for y := 0; y+1 < hm.height; y++ {
+			for x := 0; x+1 < hm.width; x++ {
+				a, b := y*hm.width+x, y*hm.width+x+1
+				c, d := (y+1)*hm.width+x, (y+1)*hm.width+x+1
+				if hm.water[a] == hm.water[d] && hm.water[b] == hm.water[c] && hm.water[a] != hm.water[b] {
+					// the land pair of the block becomes water, or the water pair becomes land
+					if hm.water[a] == to_water {
+						hm.setWater(b, to_water)
+					} else {
+						hm.setWater(a, to_water)
+					}
+					found++
+				}
+			}
+		}
+		changed += found
+		if found == 0 {
+			break
+		}
+	}
+	return changed
+}
+
+// cleanWater applies the water mask clean-up and reports what it changed.
+func (hm *heightMap) cleanWater(wm waterMask) {
+	if wm.Dilate > 0 {
+		fmt.Printf("water mask: %d pixels flooded by dilate\n", hm.morphWater(wm.Dilate, true))
+	}
+	if wm.Erode > 0 {
+		fmt.Printf("water mask: %d pixels dried by erode\n", hm.morphWater(wm.Erode, false))
+	}
+
+	if wm.Minisland > 0 {
+		keep := make(map[int]bool)
+		for _, p := range wm.Keep {
+			x, y := map_projection.latLonToPixel(p.Lat, p.Lon)
+			px, py := int(math.Floor(x+0.5)), int(math.Floor(y+0.5))
+			if px < 0 || py < 0 || px >= hm.width || py >= hm.height {
+				fmt.Printf("water mask: keep point %q is outside the map\n", p.Name)
+				continue
+			}
+			keep[py*hm.width+px] = true
+		}
+		removed := 0
+		for _, island := range hm.components(false) {
+			if len(island) >= wm.Minisland {
+				continue
+			}
+			kept := false
+			for _, i := range island {
+				kept = kept || keep[i]
+			}
+			if kept {
+				continue
+			}
+			for _, i := range island {
+				hm.setWater(i, true)
+			}
+			removed++
+		}
+		fmt.Printf("water mask: %d islands removed\n", removed)
+	}
+
+	if wm.Minlake > 0 {
+		removed := 0
+		for _, lake := range hm.components(true) {
+			if len(lake) >= wm.Minlake {
+				continue
+			}
+			// water reaching the edge of the map may be the sea, leave it
+			open := false
+			for _, i := range lake {
+				x, y := i%hm.width, i/hm.width
+				open = open || x == 0 || y == 0 || x == hm.width-1 || y == hm.height-1
+			}
+			if open {
+				continue
+			}
+			for _, i := range lake {
+				hm.setWater(i, false)
+			}
+			removed++
+		}
+		fmt.Printf("water mask: %d lakes removed\n", removed)
+	}
+
+	switch strings.ToLower(wm.Diagonals) {
+	case "":
+	case "water":
+		fmt.Printf("water mask: %d diagonal connections opened\n", hm.fixDiagonals(true))
+	case "land":
+		fmt.Printf("water mask: %d diagonal connections closed\n", hm.fixDiagonals(false))
+	default:
+		log.Fatalf("drawing.watermask: diagonals must be water or land, got %q\n", wm.Diagonals)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// maskHeightMap returns a heightMap drawn with ~ for water and # for land at 20 m.
+func maskHeightMap(rows ...string) *heightMap {
+	hm := newHeightMap(len(rows[0]), len(rows))
+	for y, row := range rows {
+		for x, c := range row {
+			i := y*hm.width + x
+			if c == '~' {
+				hm.water[i], hm.elevation[i], hm.coverage[i] = true, float32(water_level), 1
+			} else {
+				hm.elevation[i] = 20
+			}
+		}
+	}
+	return hm
+}
+
+// maskRows draws the water mask of hm like maskHeightMap.
+func maskRows(hm *heightMap) string {
+	var b strings.Builder
+	for i := range hm.water {
+		if i > 0 && i%hm.width == 0 {
+			b.WriteByte('\n')
+		}
+		if hm.water[i] {
+			b.WriteByte('~')
+		} else {
+			b.WriteByte('#')
+		}
+	}
+	return b.String()
+}
+
+func TestCleanWaterIslandsAndLakes(t *testing.T) {
+	defer func(w int16) { water_level = w }(water_level)
+	water_level = 0
+	hm := maskHeightMap(
+		"~~~~~~~~~~",
+		"~#~~~####~",
+		"~~~~~#~~#~",
+		"~~~~~####~",
+		"~~~~~~~~~~",
+	)
+	hm.cleanWater(waterMask{Minisland: 2, Minlake: 3})
+	want := strings.Join([]string{
+		"~~~~~~~~~~",
+		"~~~~~####~",
+		"~~~~~####~",
+		"~~~~~####~",
+		"~~~~~~~~~~",
+	}, "\n")
+	if got := maskRows(hm); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	// the removed island is at the water level and the filled lake takes the land around it
+	if e := hm.elevation[1*hm.width+1]; e != 0 {
+		t.Errorf("removed island at %v", e)
+	}
+	if e := hm.elevation[2*hm.width+6]; e != 20 {
+		t.Errorf("filled lake at %v, want 20", e)
+	}
+
+	// the sea reaching the edge is never filled, however small
+	edge := maskHeightMap("##~", "###", "###")
+	edge.cleanWater(waterMask{Minlake: 5})
+	if !edge.water[2] {
+		t.Errorf("water at the edge filled")
+	}
+}
+
+func TestCleanWaterDiagonals(t *testing.T) {
+	defer func(w int16) { water_level = w }(water_level)
+	water_level = 0
+	for _, to := range []string{"water", "land"} {
+		hm := maskHeightMap(
+			"~~###",
+			"~~###",
+			"##~~~",
+			"##~~#",
+			"###~#",
+		)
+		hm.cleanWater(waterMask{Diagonals: to})
+		for y := 0; y+1 < hm.height; y++ {
+			for x := 0; x+1 < hm.width; x++ {
+				a, b := y*hm.width+x, y*hm.width+x+1
+				c, d := (y+1)*hm.width+x, (y+1)*hm.width+x+1
+				if hm.water[a] == hm.water[d] && hm.water[b] == hm.water[c] && hm.water[a] != hm.water[b] {
+					t.Errorf("diagonals %s: corner left at %d,%d in\n%s", to, x, y, maskRows(hm))
+				}
+			}
+		}
+	}
+}
+
+func TestMorphWater(t *testing.T) {
+	defer func(w int16) { water_level = w }(water_level)
+	water_level = 0
+	hm := maskHeightMap("#####", "#####", "##~##", "#####", "#####")
+	if n := hm.morphWater(1, true); n != 4 {
+		t.Errorf("dilate flooded %d pixels, want 4", n)
+	}
+	want := "#####\n##~##\n#~~~#\n##~##\n#####"
+	if got := maskRows(hm); got != want {
+		t.Errorf("dilate: got\n%s\nwant\n%s", got, want)
+	}
+	// eroding by the same radius opens the cross back to its centre
+	if n := hm.morphWater(1, false); n != 4 {
+		t.Errorf("erode dried %d pixels, want 4", n)
+	}
+	want = "#####\n#####\n##~##\n#####\n#####"
+	if got := maskRows(hm); got != want {
+		t.Errorf("erode: got\n%s\nwant\n%s", got, want)
+	}
+}